@@ -1,19 +1,46 @@
 package art
 
 import (
+	"bytes"
 	"runtime"
+	"sync/atomic"
 	"unsafe"
 )
 
 // ART an adaptive radix tree implementation
 type ART struct {
-	root *node
+	size  int64
+	root  *node
+	clock *clock
+	// the version of the tree that's read from. a version
+	// of zero reads the latest version of the tree
+	version uint64
+	// set once the tree has been hashed, so writers
+	// know to invalidate the hashes cached on nodes
+	hashing int32
+	// the transaction whose changes are read along with the latest
+	// version of the tree, while the transaction is being committed
+	txn *commit
+	// the generation of the nodes that belong to the tree. it's
+	// changed when the tree is cloned, so the nodes it shares with
+	// the clone are copied before either tree changes them
+	gen uint64
 }
 
+// the last generation given to a tree
+var generation uint64
+
 // New creates a new radix tree
 func New() *ART {
+	gen := atomic.AddUint64(&generation, 1)
+
+	root := newNode(Node256, nil, nil)
+	root.gen = gen
+
 	return &ART{
-		root: newNode(Node256, nil, nil),
+		root:  root,
+		clock: newClock(),
+		gen:   gen,
 	}
 }
 
@@ -21,19 +48,13 @@ func New() *ART {
 func (t *ART) Insert(key []byte, value Comparable) bool {
 	var success bool
 
+	w := t.clock.begin()
+	defer t.clock.end(&w)
+
 	parent, current, pos, dv := t.find(key)
 
 	for {
-		switch {
-		case shouldInsert(key, current, parent, pos, dv):
-			success = t.insertNode(key, value, parent, current, pos, dv)
-		case shouldUpdate(key, current, parent, pos, dv):
-			success = t.updateNode(key, value, parent, current, pos, dv)
-		case shouldSplitThreeWay(key, current, parent, pos, dv):
-			success = t.splitThreeWay(key, value, parent, current, pos, dv)
-		case shouldSplitTwoWay(key, current, parent, pos, dv):
-			success = t.splitTwoWay(key, value, parent, current, pos, dv)
-		}
+		success = t.store(key, value, parent, current, pos, dv, &w)
 
 		if success {
 			return true
@@ -70,17 +91,11 @@ func (t *ART) Swap(key []byte, old, new Comparable) bool {
 		}
 	}
 
+	w := t.clock.begin()
+	defer t.clock.end(&w)
+
 	for {
-		switch {
-		case shouldInsert(key, current, parent, pos, dv):
-			success = t.insertNode(key, new, parent, current, pos, dv)
-		case shouldUpdate(key, current, parent, pos, dv):
-			success = t.updateNode(key, new, parent, current, pos, dv)
-		case shouldSplitThreeWay(key, current, parent, pos, dv):
-			success = t.splitThreeWay(key, new, parent, current, pos, dv)
-		case shouldSplitTwoWay(key, current, parent, pos, dv):
-			success = t.splitTwoWay(key, new, parent, current, pos, dv)
-		}
+		success = t.located(key, parent, current) && t.store(key, new, parent, current, pos, dv, &w)
 
 		if success {
 			return true
@@ -95,17 +110,707 @@ func (t *ART) Swap(key []byte, old, new Comparable) bool {
 	}
 }
 
+// LoadOrStore returns the existing value for a key if there is one.
+// otherwise it stores the given value. loaded is true if the value was
+// loaded and false if it was stored
+func (t *ART) LoadOrStore(key []byte, value Comparable) (actual Comparable, loaded bool) {
+	w := t.clock.begin()
+	defer t.clock.end(&w)
+
+	for {
+		parent, current, pos, dv := t.find(key)
+
+		if current != nil && shouldUpdate(key, current, parent, pos, dv) && current.value != nil {
+			return current.value, true
+		}
+
+		if t.store(key, value, parent, current, pos, dv, &w) {
+			return value, false
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// LoadAndDelete removes a key, returning its previous value if there was one
+func (t *ART) LoadAndDelete(key []byte) (Comparable, bool) {
+	return t.remove(key, nil)
+}
+
+// Update atomically updates the value of a key with the result of fn.
+// fn is called with the key's current value and whether it exists, and returns
+// the value to store or true if the key should be deleted. Returning a nil value
+// also deletes the key. If the value is changed concurrently, fn will be called
+// again with the new value
+func (t *ART) Update(key []byte, fn func(old Comparable, exists bool) (new Comparable, del bool)) Comparable {
+	for {
+		var old Comparable
+		var success bool
+
+		parent, current, pos, dv := t.find(key)
+
+		exists := current != nil && shouldUpdate(key, current, parent, pos, dv) && current.value != nil
+		if exists {
+			old = current.value
+		}
+
+		value, del := fn(old, exists)
+
+		// a key can't be stored without a value
+		del = del || value == nil
+
+		if del && !exists {
+			return nil
+		}
+
+		// fn is called before the write starts, as it could take a snapshot
+		w := t.clock.begin()
+
+		switch {
+		case !t.located(key, parent, current):
+			// the key was moved while fn was being called
+		case del:
+			success = t.deleteNode(key, parent, current, pos, dv, &w)
+			if success {
+				t.compact(key[:pos-(len(current.prefix)+1)], &w)
+				value = nil
+			}
+		default:
+			success = t.store(key, value, parent, current, pos, dv, &w)
+		}
+
+		t.clock.end(&w)
+
+		if success {
+			return value
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// Delete removes a key from the tree
+func (t *ART) Delete(key []byte) bool {
+	_, ok := t.remove(key, nil)
+	return ok
+}
+
+// CompareAndDelete atomically removes a key if its value matches the old value
+func (t *ART) CompareAndDelete(key []byte, old Comparable) bool {
+	if old == nil {
+		return false
+	}
+
+	_, ok := t.remove(key, func(value Comparable) bool {
+		return old.EqualTo(value)
+	})
+
+	return ok
+}
+
+// remove deletes a key if the provided match function returns true
+// for its current value, returning the value that was removed
+func (t *ART) remove(key []byte, match func(value Comparable) bool) (Comparable, bool) {
+	for {
+		parent, current, pos, dv := t.find(key)
+
+		if current == nil || !shouldUpdate(key, current, parent, pos, dv) || current.value == nil {
+			return nil, false
+		}
+
+		if match != nil && !match(current.value) {
+			return nil, false
+		}
+
+		edgePos := pos - (len(current.prefix) + 1)
+
+		w := t.clock.begin()
+
+		success := t.located(key, parent, current) && t.deleteNode(key, parent, current, pos, dv, &w)
+		if success {
+			// the parent may be left with a single child it can be merged with
+			t.compact(key[:edgePos], &w)
+		}
+
+		t.clock.end(&w)
+
+		if success {
+			return current.value, true
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// DeletePrefix removes every key that starts with the given prefix, returning
+// the number of keys that were removed. The node holding the prefix is unlinked
+// from its parent in a single swap while writes to the tree are paused, so the
+// keys are removed atomically, in a time that doesn't depend on how many there are
+func (t *ART) DeletePrefix(prefix []byte) int {
+	if len(prefix) < 1 {
+		var removed int
+
+		// the root can't be unlinked, so remove each of its edges in turn
+		for i := 0; i < 256; i++ {
+			removed = removed + t.DeletePrefix([]byte{byte(i)})
+		}
+
+		return removed
+	}
+
+	w := t.clock.lock()
+	_, n := t.detachPrefix(prefix, &w)
+	t.clock.unlock()
+
+	if n == nil {
+		return 0
+	}
+
+	// nothing can reach the node now it has been unlinked,
+	// so its keys can be counted after the tree is resumed
+	removed := int(n.total())
+
+	atomic.AddInt64(&t.size, -int64(removed))
+
+	return removed
+}
+
+// detachPrefix unlinks the node holding a prefix from the tree, returning the
+// node's key and the node. the tree must be paused, as the node is unlinked
+// without freezing the nodes below it, which writers could still be changing
+func (t *ART) detachPrefix(prefix []byte, w *write) ([]byte, *node) {
+	for {
+		var key []byte
+		var edgePos int
+
+		parent, current, pos, dv := t.own(prefix, w)
+
+		switch {
+		case current == nil:
+			return nil, nil
+		case shouldUpdate(prefix, current, parent, pos, dv):
+			edgePos = pos - (len(current.prefix) + 1)
+			key = prefix
+		case pos+dv == len(prefix):
+			// the prefix ends part way through the node's prefix
+			edgePos = pos - 1
+			key = childKey(prefix[:edgePos], prefix[edgePos], current)
+		default:
+			return nil, nil
+		}
+
+		if parent.swapNext(prefix[edgePos], current, nil, w) {
+			t.invalidate(prefix[:edgePos], w)
+			t.compact(prefix[:edgePos], w)
+			return key, current
+		}
+	}
+}
+
+// DeleteRange removes every key from start up to, but not including end, returning
+// the number of keys that were removed. If end is empty, all keys from start onwards
+// will be removed. Subtrees that are entirely inside the range are removed with
+// DeletePrefix, so the range as a whole is not removed atomically
+func (t *ART) DeleteRange(start, end []byte) int {
+	var removed int
+	var keys, prefixes [][]byte
+
+	t.rangeSubtrees(nil, t.root, start, end, true, len(end) > 0, func(key []byte, subtree bool) {
+		if subtree {
+			prefixes = append(prefixes, key)
+		} else {
+			keys = append(keys, key)
+		}
+	})
+
+	for _, prefix := range prefixes {
+		removed = removed + t.DeletePrefix(prefix)
+	}
+
+	for _, key := range keys {
+		if t.Delete(key) {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// rangeSubtrees visits the nodes of a node's subtree that are inside the range.
+// if every key under a node is in the range, fn is called with subtree set and its
+// children are not visited. otherwise fn is only called for the node's own key
+func (t *ART) rangeSubtrees(key []byte, current *node, start, end []byte, lower, upper bool, fn func(key []byte, subtree bool)) {
+	d := len(key)
+
+	if lower && len(start) == d {
+		lower = false
+	}
+
+	if upper && len(end) == d {
+		return
+	}
+
+	if !lower && !upper {
+		fn(key, true)
+		return
+	}
+
+	if !lower && current.value != nil {
+		fn(key, false)
+	}
+
+	lo, hi := rangeEdges(d, start, end, lower, upper)
+
+	e := current.getEdges()
+
+	for i := lo; i <= hi; i++ {
+		b, next := e.ceiling(byte(i))
+		if next == nil || int(b) > hi {
+			break
+		}
+
+		i = int(b)
+
+		nl, nu, ok := rangeBounds(next, d, start, end, lower && i == lo, upper && i == hi)
+		if !ok {
+			continue
+		}
+
+		t.rangeSubtrees(childKey(key, b, next), next, start, end, nl, nu, fn)
+	}
+}
+
+// Clone creates an independent copy of the tree, which can be changed without
+// affecting the original. The trees share all of their nodes, apart from the root,
+// so cloning takes constant time. A node that's shared is copied by whichever tree
+// changes it first, along with the shared nodes above it, so each tree only copies
+// the nodes on the paths to the keys it changes. Writes are paused while the tree
+// is cloned, so the clone is consistent with the tree at the point it was cloned
+func (t *ART) Clone() *ART {
+	t.clock.lock()
+	defer t.clock.unlock()
+
+	c := &ART{
+		size:  atomic.LoadInt64(&t.size),
+		clock: t.clock,
+		gen:   atomic.AddUint64(&generation, 1),
+	}
+
+	c.root = &node{
+		edges: copyEdges(t.root),
+		gen:   c.gen,
+	}
+
+	// every node below the root now belongs to neither tree
+	atomic.StoreUint64(&t.gen, atomic.AddUint64(&generation, 1))
+	atomic.StoreUint64(&t.root.gen, t.gen)
+
+	return c
+}
+
+// copyNode copies a node and all of the nodes below it,
+// giving the copies the generation of the tree they're for
+func (t *ART) copyNode(n *node, gen uint64) *node {
+	var size uint64
+
+	ne := t.getEdges(n).copy()
+
+	for i := 0; i < 256; i++ {
+		b, next := ne.ceiling(byte(i))
+		if next == nil {
+			break
+		}
+
+		i = int(b)
+
+		cn := t.copyNode(next, gen)
+		ne.setNext(b, cn)
+
+		size = size + cn.total()
+	}
+
+	e := unsafe.Pointer(&ne)
+
+	return &node{
+		size:   sizeCounted | size,
+		prefix: n.prefix,
+		value:  n.value,
+		edges:  &e,
+		gen:    gen,
+	}
+}
+
+// owns returns true if a node belongs to the tree, rather than being shared with a clone
+func (t *ART) owns(n *node) bool {
+	return atomic.LoadUint64(&n.gen) == atomic.LoadUint64(&t.gen)
+}
+
+// edgesOf returns the edges for a copy of a node. a node that belongs to the tree
+// shares its edges with the copy, while the edges of a node that's shared with a
+// clone are copied, so changes made through the copy don't affect the clone
+func (t *ART) edgesOf(n *node) *unsafe.Pointer {
+	if t.owns(n) {
+		return n.edges
+	}
+
+	return copyEdges(n)
+}
+
+// copyEdges returns a new pointer to the latest version of a node's edges
+func copyEdges(n *node) *unsafe.Pointer {
+	e := n.getEdges()
+
+	if v, versioned := e.(*edgesVersion); versioned {
+		e = v.edges
+	}
+
+	p := unsafe.Pointer(&e)
+
+	return &p
+}
+
+// own finds the position of a key, like find, after copying any nodes above it
+// that are shared with a clone, so the parent returned belongs to the tree. each
+// node is copied in a single swap, working down from the root
+func (t *ART) own(key []byte, w *write) (*node, *node, int, int) {
+	for {
+		parent, current, pos, dv := t.find(key)
+
+		if t.owns(parent) {
+			return parent, current, pos, dv
+		}
+
+		t.copyShared(key, w)
+	}
+}
+
+// copyShared replaces the first node above a key that's shared with a clone
+// with a copy that belongs to the tree
+func (t *ART) copyShared(key []byte, w *write) {
+	var pos int
+
+	current := t.root
+
+	for pos < len(key) {
+		next := t.getEdges(current).next(key[pos])
+		if next == nil {
+			return
+		}
+
+		// only the nodes above the key need to belong to the tree
+		end := pos + len(next.prefix) + 1
+
+		if end >= len(key) || !bytes.Equal(next.prefix, key[pos+1:end]) {
+			return
+		}
+
+		if !t.owns(next) {
+			n := &node{
+				prefix: next.prefix,
+				value:  next.value,
+				edges:  copyEdges(next),
+				gen:    t.gen,
+			}
+
+			if current.swapNext(key[pos], next, n, w) {
+				t.invalidate(key[:pos], w)
+			}
+
+			return
+		}
+
+		pos = end
+		current = next
+	}
+}
+
+// Len returns the number of keys stored in the tree
+func (t *ART) Len() int {
+	return int(atomic.LoadInt64(&t.size))
+}
+
+// CountPrefix returns the number of keys stored with the given prefix
+func (t *ART) CountPrefix(prefix []byte) int {
+	if len(prefix) < 1 {
+		// the root's size isn't kept up to date, as it would have
+		// to be counted again every time a key in the tree changes
+		return t.Len()
+	}
+
+	_, current := t.findPrefix(prefix)
+	if current == nil {
+		return 0
+	}
+
+	return int(current.total())
+}
+
+// Rank returns the number of keys in the tree that are less than the given key
+func (t *ART) Rank(key []byte) int {
+	var rank uint64
+	var d int
+
+	current := t.root
+
+	for d < len(key) {
+		// the node's key is a prefix of the key, so it sorts before it
+		if current.value != nil {
+			rank++
+		}
+
+		e := current.getEdges()
+
+		// count every key under the edges that sort before the key's next byte
+		for i := 0; i < int(key[d]); i++ {
+			b, next := e.ceiling(byte(i))
+			if next == nil || b >= key[d] {
+				break
+			}
+
+			i = int(b)
+			rank = rank + next.total()
+		}
+
+		next := e.next(key[d])
+		if next == nil {
+			break
+		}
+
+		switch compareBound(next.prefix, key[d+1:]) {
+		case -1:
+			// every key under the child is before the key
+			return int(rank + next.total())
+		case 1:
+			// every key under the child is after the key
+			return int(rank)
+		}
+
+		d = d + len(next.prefix) + 1
+		current = next
+	}
+
+	return int(rank)
+}
+
+// Select returns the key at the given position in the tree's sorted keys
+func (t *ART) Select(i int) ([]byte, Comparable, bool) {
+	if i < 0 {
+		return nil, nil, false
+	}
+
+	var key []byte
+
+	current := t.root
+	remaining := uint64(i)
+
+	for {
+		if current.value != nil {
+			if remaining == 0 {
+				return key, current.value, true
+			}
+
+			remaining--
+		}
+
+		var selected *node
+
+		e := current.getEdges()
+
+		// skip over the children whose keys all sort before the position
+		for j := 0; j < 256; j++ {
+			b, next := e.ceiling(byte(j))
+			if next == nil {
+				break
+			}
+
+			j = int(b)
+
+			total := next.total()
+			if remaining < total {
+				key = childKey(key, b, next)
+				selected = next
+				break
+			}
+
+			remaining = remaining - total
+		}
+
+		if selected == nil {
+			return nil, nil, false
+		}
+
+		current = selected
+	}
+}
+
 // Lookup a value from the tree
 func (t *ART) Lookup(key []byte) interface{} {
-	_, current, pos, _ := t.find(key)
+	parent, current, pos, dv := t.find(key)
 
-	if current == nil || len(key) > pos {
+	if current == nil || !shouldUpdate(key, current, parent, pos, dv) {
 		return nil
 	}
 
 	return current.value
 }
 
+// LongestPrefix returns the longest stored key that is a prefix of the given key
+func (t *ART) LongestPrefix(key []byte) ([]byte, Comparable, bool) {
+	var matched int
+	var value Comparable
+
+	t.prefixes(key, func(n int, v Comparable) bool {
+		matched, value = n, v
+		return true
+	})
+
+	if value == nil {
+		return nil, nil, false
+	}
+
+	return key[:matched], value, true
+}
+
+// Prefixes calls fn for every stored key that is a prefix of the given key,
+// shortest first. Iteration will stop if fn returns false
+func (t *ART) Prefixes(key []byte, fn func(key []byte, value Comparable) bool) {
+	t.prefixes(key, func(n int, value Comparable) bool {
+		return fn(key[:n], value)
+	})
+}
+
+// Min returns the smallest key in the tree and its value
+func (t *ART) Min() ([]byte, Comparable, bool) {
+	return t.MinPrefix(nil)
+}
+
+// Max returns the largest key in the tree and its value
+func (t *ART) Max() ([]byte, Comparable, bool) {
+	return t.MaxPrefix(nil)
+}
+
+// MinPrefix returns the smallest key with the given prefix and its value
+func (t *ART) MinPrefix(prefix []byte) ([]byte, Comparable, bool) {
+	key, current := t.findPrefix(prefix)
+	if current == nil {
+		return nil, nil, false
+	}
+
+	// a node's key is smaller than any of its children's keys,
+	// so follow the lowest edge until we find a node with a value
+	for current.value == nil {
+		b, next := t.getEdges(current).minimum()
+		if next == nil {
+			// we've reached a node with no value or children, so fall back to
+			// a range scan, which will move on to the next node
+			return t.first(prefix, t.Range)
+		}
+
+		key = childKey(key, b, next)
+		current = next
+	}
+
+	return key, current.value, true
+}
+
+// MaxPrefix returns the largest key with the given prefix and its value
+func (t *ART) MaxPrefix(prefix []byte) ([]byte, Comparable, bool) {
+	key, current := t.findPrefix(prefix)
+	if current == nil {
+		return nil, nil, false
+	}
+
+	// follow the highest edge until we reach a node with no children
+	for {
+		b, next := t.getEdges(current).maximum()
+		if next == nil {
+			break
+		}
+
+		key = childKey(key, b, next)
+		current = next
+	}
+
+	if current.value == nil {
+		return t.first(prefix, t.RangeReverse)
+	}
+
+	return key, current.value, true
+}
+
+// Floor returns the largest key that is less than or equal to the given key
+func (t *ART) Floor(key []byte) ([]byte, Comparable, bool) {
+	return t.neighbour(key, true, true)
+}
+
+// Ceiling returns the smallest key that is greater than or equal to the given key
+func (t *ART) Ceiling(key []byte) ([]byte, Comparable, bool) {
+	return t.neighbour(key, true, false)
+}
+
+// Predecessor returns the largest key that is less than the given key
+func (t *ART) Predecessor(key []byte) ([]byte, Comparable, bool) {
+	return t.neighbour(key, false, true)
+}
+
+// Successor returns the smallest key that is greater than the given key
+func (t *ART) Successor(key []byte) ([]byte, Comparable, bool) {
+	return t.neighbour(key, false, false)
+}
+
+// neighbour seeks to the first key equal to or greater than the given key,
+// then moves to the closest key in the given direction if needed
+func (t *ART) neighbour(key []byte, inclusive, reverse bool) ([]byte, Comparable, bool) {
+	var ok bool
+
+	c := t.Cursor()
+
+	found := c.Seek(key)
+	exact := found && bytes.Equal(c.Key(), key)
+
+	switch {
+	case exact && inclusive:
+		ok = true
+	case reverse && found:
+		ok = c.Prev()
+	case reverse:
+		// every key is smaller than the one we're looking for
+		ok = c.Last()
+	case exact:
+		ok = c.Next()
+	default:
+		ok = found
+	}
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	return c.Key(), c.Value(), true
+}
+
+// first returns the first key with a given prefix visited by the range function
+func (t *ART) first(prefix []byte, rangefn func(start, end []byte, fn func(key []byte, value Comparable) bool)) ([]byte, Comparable, bool) {
+	var key []byte
+	var value Comparable
+
+	rangefn(prefix, prefixEnd(prefix), func(k []byte, v Comparable) bool {
+		key, value = k, v
+		return false
+	})
+
+	return key, value, value != nil
+}
+
+// getEdges returns the edges of a node at the version of the tree being read
+func (t *ART) getEdges(n *node) edges {
+	if t.version == 0 {
+		return n.getEdgesIn(t.txn)
+	}
+
+	return n.getEdgesAt(t.version)
+}
+
 func (t *ART) find(key []byte) (*node, *node, int, int) {
 	var pos, dv int
 	var current, parent *node
@@ -115,7 +820,7 @@ func (t *ART) find(key []byte) (*node, *node, int, int) {
 	for {
 		parent = current
 
-		n := current.next(key[pos])
+		n := t.getEdges(current).next(key[pos])
 		if n == nil {
 			break
 		}
@@ -142,31 +847,94 @@ func (t *ART) find(key []byte) (*node, *node, int, int) {
 	return current, nil, pos, dv
 }
 
-func (t *ART) insertNode(key []byte, value Comparable, parent, current *node, pos, dv int) bool {
+// located returns true if a key is still at the position found for it before the
+// write started. a subtree can be unlinked by DeletePrefix while no writes are in
+// progress, so a position found outside of a write may no longer be in the tree
+func (t *ART) located(key []byte, parent, current *node) bool {
+	p, c, _, _ := t.find(key)
+	return p == parent && c == current
+}
+
+// store sets the value of a key, using the position in
+// the tree returned by find to decide how it should be stored
+func (t *ART) store(key []byte, value Comparable, parent, current *node, pos, dv int, w *write) bool {
+	var existing Comparable
+	var success bool
+	var depth int
+
+	if !t.owns(parent) {
+		// the parent is shared with a clone, so it's copied before it's changed
+		var found *node
+
+		parent, found, pos, dv = t.own(key, w)
+		if found != current {
+			return false
+		}
+	}
+
+	// depth is the length of the key of the node whose edges are swapped
+	switch {
+	case shouldInsert(key, current, parent, pos, dv):
+		depth = pos
+		success = t.insertNode(key, value, parent, current, pos, dv, w)
+	case shouldUpdate(key, current, parent, pos, dv):
+		existing = current.value
+		depth = pos - (len(current.prefix) + 1)
+		success = t.updateNode(key, value, parent, current, pos, dv, w)
+	case shouldSplitThreeWay(key, current, parent, pos, dv):
+		depth = pos - 1
+		success = t.splitThreeWay(key, value, parent, current, pos, dv, w)
+	case shouldSplitTwoWay(key, current, parent, pos, dv):
+		depth = pos - 1
+		success = t.splitTwoWay(key, value, parent, current, pos, dv, w)
+	}
+
+	if !success {
+		return false
+	}
+
+	switch {
+	case existing == nil && value != nil:
+		atomic.AddInt64(&t.size, 1)
+	case existing != nil && value == nil:
+		atomic.AddInt64(&t.size, -1)
+	case existing != nil && !t.hashed() && !w.versioned:
+		// the value of an existing key was updated, so no counts have changed
+		return true
+	}
+
+	t.invalidate(key[:depth], w)
+
+	return true
+}
+
+func (t *ART) insertNode(key []byte, value Comparable, parent, current *node, pos, dv int, w *write) bool {
 	e := unsafe.Pointer(&leaf)
 
 	n := &node{
 		prefix: key[pos+1:],
 		value:  value,
 		edges:  &e,
+		gen:    t.gen,
 	}
 
-	return parent.swapNext(key[pos], nil, n)
+	return parent.swapNext(key[pos], nil, n, w)
 }
 
-func (t *ART) updateNode(key []byte, value Comparable, parent, current *node, pos, dv int) bool {
+func (t *ART) updateNode(key []byte, value Comparable, parent, current *node, pos, dv int, w *write) bool {
 	edgePos := pos - (len(current.prefix) + 1)
 
 	n := &node{
 		prefix: current.prefix,
 		value:  value,
-		edges:  current.edges,
+		edges:  t.edgesOf(current),
+		gen:    t.gen,
 	}
 
-	return parent.swapNext(key[edgePos], current, n)
+	return parent.swapNext(key[edgePos], current, n, w)
 }
 
-func (t *ART) splitTwoWay(key []byte, value Comparable, parent, current *node, pos, dv int) bool {
+func (t *ART) splitTwoWay(key []byte, value Comparable, parent, current *node, pos, dv int, w *write) bool {
 	var pfx []byte
 
 	// fix issue where key is found, but is occupied by another current with prefix
@@ -180,44 +948,202 @@ func (t *ART) splitTwoWay(key []byte, value Comparable, parent, current *node, p
 		prefix: pfx,
 		value:  value,
 		edges:  &e1,
+		gen:    t.gen,
 	}
 
 	n2 := &node{
 		prefix: current.prefix[dv+1:],
 		value:  current.value,
-		edges:  current.edges,
+		edges:  t.edgesOf(current),
+		gen:    t.gen,
 	}
 
 	n1.setNext(current.prefix[dv], n2)
 
-	return parent.swapNext(key[pos-1], current, n1)
+	return parent.swapNext(key[pos-1], current, n1, w)
 }
 
-func (t *ART) splitThreeWay(key []byte, value Comparable, parent, current *node, pos, dv int) bool {
+func (t *ART) splitThreeWay(key []byte, value Comparable, parent, current *node, pos, dv int, w *write) bool {
 	e1 := unsafe.Pointer(newEdges4p())
 	e3 := unsafe.Pointer(&leaf)
 
 	n1 := &node{
 		prefix: current.prefix[:dv],
 		edges:  &e1,
+		gen:    t.gen,
 	}
 
 	n2 := &node{
 		prefix: current.prefix[dv+1:],
 		value:  current.value,
-		edges:  current.edges,
+		edges:  t.edgesOf(current),
+		gen:    t.gen,
 	}
 
 	n3 := &node{
 		prefix: key[pos+dv+1:],
 		value:  value,
 		edges:  &e3,
+		gen:    t.gen,
 	}
 
 	n1.setNext(current.prefix[dv], n2)
 	n1.setNext(key[pos+dv], n3)
 
-	return parent.swapNext(key[pos-1], current, n1)
+	return parent.swapNext(key[pos-1], current, n1, w)
+}
+
+func (t *ART) deleteNode(key []byte, parent, current *node, pos, dv int, w *write) bool {
+	var success bool
+
+	if !t.owns(parent) {
+		// the parent is shared with a clone, so it's copied before it's changed
+		var found *node
+
+		parent, found, pos, dv = t.own(key, w)
+		if found != current {
+			return false
+		}
+	}
+
+	edgePos := pos - (len(current.prefix) + 1)
+
+	if current.getEdges().count() > 1 {
+		n := &node{
+			prefix: current.prefix,
+			edges:  t.edgesOf(current),
+			gen:    t.gen,
+		}
+
+		success = parent.swapNext(key[edgePos], current, n, w)
+	} else {
+		success = t.unlink(parent, current, key[edgePos], w)
+	}
+
+	if !success {
+		return false
+	}
+
+	atomic.AddInt64(&t.size, -1)
+	t.invalidate(key[:edgePos], w)
+
+	return true
+}
+
+// unlink removes a node from its parent, replacing it with its child if it
+// only has one. the node's edges are frozen while this happens, so nothing
+// can be added underneath it once it has been unlinked. a node that's shared
+// with a clone can't be changed, so it doesn't need to be frozen
+func (t *ART) unlink(parent, current *node, b byte, w *write) bool {
+	var e *edges
+
+	owned := t.owns(current)
+
+	if owned {
+		var ok bool
+
+		e, ok = current.freeze()
+		if !ok {
+			return false
+		}
+	} else {
+		ce := current.getEdges()
+		e = &ce
+	}
+
+	var n *node
+
+	switch (*e).count() {
+	case 0:
+	case 1:
+		cb, child := (*e).minimum()
+
+		prefix := make([]byte, 0, len(current.prefix)+len(child.prefix)+1)
+		prefix = append(prefix, current.prefix...)
+		prefix = append(prefix, cb)
+		prefix = append(prefix, child.prefix...)
+
+		n = &node{
+			prefix: prefix,
+			value:  child.value,
+			edges:  t.edgesOf(child),
+			gen:    t.gen,
+		}
+	default:
+		if owned {
+			current.thaw(e)
+		}
+		return false
+	}
+
+	if !parent.swapNext(b, current, n, w) {
+		if owned {
+			current.thaw(e)
+		}
+		return false
+	}
+
+	return true
+}
+
+// compact removes or merges any valueless nodes with less than two
+// children, working up from the node at the given key
+func (t *ART) compact(key []byte, w *write) {
+	for len(key) > 0 {
+		parent, current, pos, dv := t.own(key, w)
+
+		if current == nil || !shouldUpdate(key, current, parent, pos, dv) {
+			return
+		}
+
+		if current.value != nil || current.getEdges().count() > 1 {
+			return
+		}
+
+		edgePos := pos - (len(current.prefix) + 1)
+
+		if !t.unlink(parent, current, key[edgePos], w) {
+			runtime.Gosched()
+			continue
+		}
+
+		t.invalidate(key[:edgePos], w)
+
+		key = key[:edgePos]
+	}
+}
+
+// invalidate discards the counted sizes of the nodes on the path to a key whose
+// edges have changed, so they're counted again the next time they're needed. the
+// path is looked up after the edges have changed, so any node that's added to it
+// later can only be counted once the change is visible. the root's size is only
+// invalidated if the tree has been hashed, so the hash cached for it isn't used.
+// if a snapshot was in use when the write started, the nodes are also marked as
+// changed at the write's version, so Diff can skip the nodes that haven't been
+func (t *ART) invalidate(key []byte, w *write) {
+	t.invalidateFrom(key, 0, t.root, w)
+}
+
+// invalidateFrom invalidates the sizes of the nodes on the path to a key below
+// the node at the given position, then the node's own size. nodes are invalidated
+// from the deepest up, so anyone counting a node after it has been invalidated
+// will find its children have also been invalidated
+func (t *ART) invalidateFrom(key []byte, pos int, current *node, w *write) {
+	if pos < len(key) {
+		next := current.next(key[pos])
+
+		if next != nil && pos+len(next.prefix) < len(key) && divergence(next.prefix, key[pos+1:]) == len(next.prefix) {
+			t.invalidateFrom(key, pos+len(next.prefix)+1, next, w)
+		}
+	}
+
+	if w.versioned {
+		current.mark(w.version)
+	}
+
+	if current != t.root || t.hashed() {
+		current.invalidate()
+	}
 }
 
 func shouldInsert(key []byte, current, parent *node, pos, dv int) bool {
@@ -236,6 +1162,35 @@ func shouldSplitThreeWay(key []byte, current, parent *node, pos, dv int) bool {
 	return (len(key) - (pos + dv)) > 0
 }
 
+// prefixes calls fn with the length and value of every stored key that
+// is a prefix of the given key, shortest first, until fn returns false
+func (t *ART) prefixes(key []byte, fn func(n int, value Comparable) bool) {
+	var pos int
+
+	current := t.root
+
+	for pos < len(key) {
+		next := t.getEdges(current).next(key[pos])
+		if next == nil {
+			return
+		}
+
+		pos++
+
+		if divergence(next.prefix, key[pos:]) < len(next.prefix) {
+			return
+		}
+
+		pos = pos + len(next.prefix)
+
+		if next.value != nil && !fn(pos, next.value) {
+			return
+		}
+
+		current = next
+	}
+}
+
 // returns shared and divergent characters respectively
 func divergence(prefix, key []byte) int {
 	var i int
@@ -2,8 +2,11 @@ package art
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -85,6 +88,44 @@ func TestARTInsertLookup(t *testing.T) {
 	}
 }
 
+func TestARTLookupMissing(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Existing []string
+		Missing  []string
+	}{
+		{
+			"edge",
+			[]string{"test"},
+			[]string{"t"},
+		},
+		{
+			"prefix",
+			[]string{"test"},
+			[]string{"te", "tes", "tex", "tests"},
+		},
+		{
+			"split",
+			[]string{"test", "test1234", "test1000"},
+			[]string{"test1", "test12", "test123", "test10"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := New()
+
+			for _, k := range tc.Existing {
+				r.Insert([]byte(k), String(k))
+			}
+
+			for _, k := range tc.Missing {
+				assert.Nil(t, r.Lookup([]byte(k)), k)
+			}
+		})
+	}
+}
+
 func TestARTInsert(t *testing.T) {
 	data, err := ioutil.ReadFile("words.txt")
 	if err != nil {
@@ -155,168 +196,3378 @@ func TestARTIterate(t *testing.T) {
 	}
 }
 
-func TestConcurrentInsert(t *testing.T) {
-	var wg sync.WaitGroup
+func TestARTIteratePrefix(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Existing []string
+		Prefix   string
+		Expected []string
+	}{
+		{
+			"root",
+			[]string{"test", "tomato", "abalienate"},
+			"",
+			[]string{"abalienate", "test", "tomato"},
+		},
+		{
+			"exact",
+			[]string{"test", "test1234", "test1000", "tomato"},
+			"test",
+			[]string{"test", "test1000", "test1234"},
+		},
+		{
+			"exact-inner-node",
+			[]string{"test1234", "test1000", "tomato"},
+			"test1",
+			[]string{"test1000", "test1234"},
+		},
+		{
+			"mid-prefix",
+			[]string{"test1234", "test1000", "tomato"},
+			"tes",
+			[]string{"test1000", "test1234"},
+		},
+		{
+			"mid-prefix-leaf",
+			[]string{"test1234", "tomato"},
+			"test12",
+			[]string{"test1234"},
+		},
+		{
+			"edge-only",
+			[]string{"test1234", "tomato", "abalienate"},
+			"t",
+			[]string{"test1234", "tomato"},
+		},
+		{
+			"divergent-prefix",
+			[]string{"test1234", "test1000", "tomato"},
+			"tesla",
+			nil,
+		},
+		{
+			"missing-edge",
+			[]string{"test1234", "test1000", "tomato"},
+			"test2",
+			nil,
+		},
+		{
+			"longer-than-key",
+			[]string{"test1234", "tomato"},
+			"test12345",
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := New()
+
+			for _, k := range tc.Existing {
+				r.Insert([]byte(k), String(k))
+			}
+
+			var results []string
+
+			r.Iterate([]byte(tc.Prefix), func(key []byte, value Comparable) {
+				assert.Equal(t, String(key), value)
+				results = append(results, string(key))
+			})
+
+			assert.Equal(t, tc.Expected, results)
+		})
+	}
+}
 
+func TestARTWalk(t *testing.T) {
 	r := New()
 
-	batch := make([][][]byte, 1)
+	for _, k := range []string{"hypotensive", "hyposulfurous", "hypotensor", "hypotension", "hypotaxia", "hypotaxic"} {
+		r.Insert([]byte(k), String(k))
+	}
 
-	for i := 0; i < 1; i++ {
-		batch[i] = make([][]byte, 1000)
+	var results [][]byte
 
-		for x := 0; x < 1000; x++ {
-			batch[i][x] = []byte(uuid.New().String())
+	err := r.Walk([]byte("hypot"), func(key []byte, value Comparable) error {
+		results = append(results, key)
+		return nil
+	})
+
+	require.Nil(t, err)
+	assert.Len(t, results, 5)
+
+	results = nil
+
+	errLimit := errors.New("limit reached")
+
+	err = r.Walk(nil, func(key []byte, value Comparable) error {
+		results = append(results, key)
+
+		if len(results) == 2 {
+			return errLimit
 		}
+
+		return nil
+	})
+
+	assert.Equal(t, errLimit, err)
+	assert.Len(t, results, 2)
+}
+
+func TestARTRange(t *testing.T) {
+	keys := []string{
+		"a", "ab", "abc", "abd", "abde", "b", "ba", "bab", "test", "test1000",
+		"test1234", "tomato", "todo", "todos", "tamale", "z", "zz", "zzz",
 	}
 
-	wg.Add(1)
+	r := New()
 
-	for i := 0; i < 1; i++ {
-		go func(b int) {
-			for x := range batch[b] {
-				success := r.Insert(batch[b][x], Bytes(batch[b][x]))
-				if !success {
-					panic("failed to insert unique value")
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
+	}
+
+	sort.Strings(keys)
+
+	bounds := []string{"", "a", "aa", "ab", "abc", "abcd", "abd", "b", "bb", "t", "te", "test", "test1", "test12345", "to", "todo", "tp", "z", "zzz", "zzzz"}
+
+	for _, start := range bounds {
+		for _, end := range bounds {
+			var expected, results []string
+
+			for _, k := range keys {
+				if k >= start && (end == "" || k < end) {
+					expected = append(expected, k)
 				}
 			}
-			wg.Done()
-		}(i)
-	}
 
-	wg.Wait()
+			r.Range([]byte(start), []byte(end), func(key []byte, value Comparable) bool {
+				assert.Equal(t, String(key), value)
+				results = append(results, string(key))
+				return true
+			})
 
-	for i := 0; i < 1; i++ {
-		for x := 0; x < 1000; x++ {
-			value := r.Lookup(batch[i][x])
-			require.NotNil(t, value)
-			assert.True(t, bytes.Equal(value.(Bytes), batch[i][x]))
+			assert.Equal(t, expected, results, "range [%s, %s)", start, end)
 		}
 	}
-}
 
-func TestConcurrentInsertInt(t *testing.T) {
-	var wg sync.WaitGroup
+	var results []string
 
-	w := 32
+	r.Range([]byte("b"), nil, func(key []byte, value Comparable) bool {
+		results = append(results, string(key))
+		return len(results) < 3
+	})
+
+	assert.Equal(t, []string{"b", "ba", "bab"}, results)
+}
+
+func TestARTRangeReverse(t *testing.T) {
+	keys := []string{
+		"a", "ab", "abc", "abd", "abde", "b", "ba", "bab", "test", "test1000",
+		"test1234", "tomato", "todo", "todos", "tamale", "z", "zz", "zzz",
+	}
 
 	r := New()
 
-	batch := make([][][]byte, w)
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
+	}
 
-	for i := 0; i < w; i++ {
-		batch[i] = make([][]byte, 10000)
+	bounds := []string{"", "a", "aa", "ab", "abc", "abcd", "abd", "b", "bb", "t", "te", "test", "test1", "test12345", "to", "todo", "tp", "z", "zzz", "zzzz"}
 
-		for x := 0; x < 10000; x++ {
-			batch[i][x] = []byte(strconv.Itoa(x))
+	for _, start := range bounds {
+		for _, end := range bounds {
+			var expected, results []string
+
+			r.Range([]byte(start), []byte(end), func(key []byte, value Comparable) bool {
+				expected = append([]string{string(key)}, expected...)
+				return true
+			})
+
+			r.RangeReverse([]byte(start), []byte(end), func(key []byte, value Comparable) bool {
+				assert.Equal(t, String(key), value)
+				results = append(results, string(key))
+				return true
+			})
+
+			assert.Equal(t, expected, results, "range [%s, %s)", start, end)
 		}
 	}
 
-	wg.Add(w)
+	var results []string
 
-	for i := 0; i < w; i++ {
-		go func(b int) {
-			for x := range batch[b] {
-				r.Insert(batch[b][x], Bytes(batch[b][x]))
-			}
-			wg.Done()
-		}(i)
-	}
+	r.RangeReverse(nil, nil, func(key []byte, value Comparable) bool {
+		results = append(results, string(key))
+		return len(results) < 3
+	})
 
-	wg.Wait()
+	assert.Equal(t, []string{"zzz", "zz", "z"}, results)
+}
 
-	for x := 0; x < 1000; x++ {
-		value := r.Lookup(batch[0][x])
-		require.NotNil(t, value)
-		assert.True(t, bytes.Equal(value.(Bytes), batch[0][x]))
+func TestARTIterateReverse(t *testing.T) {
+	r := New()
+
+	for _, k := range []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "te"} {
+		r.Insert([]byte(k), String(k))
 	}
+
+	r.Insert([]byte{'t', 255, 255}, String("max"))
+	r.Insert([]byte{'u'}, String("u"))
+
+	var results []string
+
+	r.IterateReverse([]byte("tes"), func(key []byte, value Comparable) {
+		results = append(results, string(key))
+	})
+
+	assert.Equal(t, []string{"test1234", "test1000", "test"}, results)
+
+	results = nil
+
+	r.IterateReverse([]byte{'t', 255}, func(key []byte, value Comparable) {
+		results = append(results, string(value.(String)))
+	})
+
+	assert.Equal(t, []string{"max"}, results)
 }
 
-func TestSwap(t *testing.T) {
-	uuids := make([][]byte, 10000)
+func TestMinMax(t *testing.T) {
+	r := New()
 
-	for i := 0; i < 10000; i++ {
-		uuids[i] = []byte(uuid.New().String())
+	_, _, ok := r.Min()
+	assert.False(t, ok)
+
+	_, _, ok = r.Max()
+	assert.False(t, ok)
+
+	for _, k := range []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "b", "zz"} {
+		r.Insert([]byte(k), String(k))
+	}
+
+	cases := []struct {
+		Prefix string
+		Min    string
+		Max    string
+	}{
+		{"", "b", "zz"},
+		{"t", "tamale", "tomato"},
+		{"te", "test", "test1234"},
+		{"test", "test", "test1234"},
+		{"test1", "test1000", "test1234"},
+		{"tod", "todo", "todos"},
+		{"todos", "todos", "todos"},
+		{"z", "zz", "zz"},
+		{"a", "", ""},
+		{"tesla", "", ""},
+		{"todoss", "", ""},
+	}
+
+	for _, tc := range cases {
+		key, value, ok := r.MinPrefix([]byte(tc.Prefix))
+		assert.Equal(t, tc.Min != "", ok, tc.Prefix)
+
+		if ok {
+			assert.Equal(t, tc.Min, string(key))
+			assert.Equal(t, String(tc.Min), value)
+		}
+
+		key, value, ok = r.MaxPrefix([]byte(tc.Prefix))
+		assert.Equal(t, tc.Max != "", ok, tc.Prefix)
+
+		if ok {
+			assert.Equal(t, tc.Max, string(key))
+			assert.Equal(t, String(tc.Max), value)
+		}
 	}
 
+	// keys stored without a value should be skipped
+	r.Insert([]byte("a"), nil)
+	r.Insert([]byte("zzz"), nil)
+
+	key, _, ok := r.Min()
+	require.True(t, ok)
+	assert.Equal(t, "b", string(key))
+
+	key, _, ok = r.Max()
+	require.True(t, ok)
+	assert.Equal(t, "zz", string(key))
+}
+
+func TestFloorCeiling(t *testing.T) {
 	r := New()
 
-	// swap empty
-	for x := 0; x < 10000; x++ {
-		success := r.Swap(uuids[x], nil, Bytes(uuids[x]))
-		require.True(t, success)
+	for _, k := range []string{"b", "test", "test1000", "test1234", "todo", "todos", "tomato"} {
+		r.Insert([]byte(k), String(k))
 	}
 
-	v := []byte("new-value")
+	cases := []struct {
+		Key         string
+		Floor       string
+		Ceiling     string
+		Predecessor string
+		Successor   string
+	}{
+		{"a", "", "b", "", "b"},
+		{"b", "b", "b", "", "test"},
+		{"c", "b", "test", "b", "test"},
+		{"tes", "b", "test", "b", "test"},
+		{"test", "test", "test", "b", "test1000"},
+		{"test1", "test", "test1000", "test", "test1000"},
+		{"test1000", "test1000", "test1000", "test", "test1234"},
+		{"test2", "test1234", "todo", "test1234", "todo"},
+		{"todoa", "todo", "todos", "todo", "todos"},
+		{"tomato", "tomato", "tomato", "todos", ""},
+		{"z", "tomato", "", "tomato", ""},
+	}
 
-	// swap existing
-	for x := 0; x < 10000; x++ {
-		success := r.Swap(uuids[x], Bytes(uuids[x]), Bytes(v))
-		require.True(t, success)
+	check := func(fn func([]byte) ([]byte, Comparable, bool), key, expected string) {
+		k, v, ok := fn([]byte(key))
+
+		if expected == "" {
+			assert.False(t, ok, key)
+			return
+		}
+
+		require.True(t, ok, key)
+		assert.Equal(t, expected, string(k), key)
+		assert.Equal(t, String(expected), v, key)
 	}
 
-	// test swapping a value that has been inserted, but its value is nil
-	r.Insert([]byte("hello"), nil)
-	success := r.Swap([]byte("hello"), nil, String("HELLO"))
-	require.True(t, success)
+	for _, tc := range cases {
+		check(r.Floor, tc.Key, tc.Floor)
+		check(r.Ceiling, tc.Key, tc.Ceiling)
+		check(r.Predecessor, tc.Key, tc.Predecessor)
+		check(r.Successor, tc.Key, tc.Successor)
+	}
 }
 
-func TestConcurrentSwap(t *testing.T) {
-	for x := 0; x < 100; x++ {
-		var wg sync.WaitGroup
-		var failures int64
+func TestLongestPrefix(t *testing.T) {
+	r := New()
 
-		w := 32
+	for _, k := range []string{"/", "/org", "/org/team", "/org/team-b", "/other", "10.0.", "10.0.0.", "10.1."} {
+		r.Insert([]byte(k), String(k))
+	}
 
-		r := New()
+	cases := []struct {
+		Key     string
+		Matched string
+	}{
+		{"/", "/"},
+		{"/o", "/"},
+		{"/org", "/org"},
+		{"/org/", "/org"},
+		{"/org/team", "/org/team"},
+		{"/org/team/member", "/org/team"},
+		{"/org/team-b/member", "/org/team-b"},
+		{"/org/team-c", "/org/team"},
+		{"/org/tea", "/org"},
+		{"/others", "/other"},
+		{"10.0.0.1", "10.0.0."},
+		{"10.0.1.1", "10.0."},
+		{"10.2.0.1", ""},
+		{"org", ""},
+		{"", ""},
+	}
 
-		wg.Add(w)
+	for _, tc := range cases {
+		matched, value, ok := r.LongestPrefix([]byte(tc.Key))
 
-		for i := 0; i < w; i++ {
-			go func(b int) {
-				val := fmt.Sprintf("test-value-%d", b)
+		if tc.Matched == "" {
+			assert.False(t, ok, tc.Key)
+			continue
+		}
 
-				if !r.Swap([]byte("test-key"), nil, Bytes(val)) {
-					atomic.AddInt64(&failures, 1)
-				}
+		require.True(t, ok, tc.Key)
+		assert.Equal(t, tc.Matched, string(matched))
+		assert.Equal(t, String(tc.Matched), value)
+	}
+}
 
-				wg.Done()
-			}(i)
-		}
+func TestPrefixes(t *testing.T) {
+	r := New()
 
-		wg.Wait()
+	for _, k := range []string{"/", "/org", "/org/team", "/org/team-b", "/other"} {
+		r.Insert([]byte(k), String(k))
+	}
 
-		assert.Equal(t, int64(w-1), failures)
+	cases := []struct {
+		Key      string
+		Expected []string
+	}{
+		{"/org/team/member", []string{"/", "/org", "/org/team"}},
+		{"/org/team-b", []string{"/", "/org", "/org/team", "/org/team-b"}},
+		{"/others", []string{"/", "/other"}},
+		{"/o", []string{"/"}},
+		{"org", nil},
 	}
 
-	for x := 0; x < 100; x++ {
-		var wg sync.WaitGroup
-		var failures int64
+	for _, tc := range cases {
+		var results []string
 
-		w := 32
+		r.Prefixes([]byte(tc.Key), func(key []byte, value Comparable) bool {
+			assert.Equal(t, String(key), value)
+			results = append(results, string(key))
+			return true
+		})
 
-		r := New()
+		assert.Equal(t, tc.Expected, results, tc.Key)
+	}
 
-		wg.Add(w)
+	var results []string
 
-		r.Insert([]byte("test-key"), Bytes("test-value"))
+	r.Prefixes([]byte("/org/team"), func(key []byte, value Comparable) bool {
+		results = append(results, string(key))
+		return len(results) < 2
+	})
 
-		for i := 0; i < w; i++ {
-			go func(b int) {
-				val := fmt.Sprintf("test-value-%d", b)
+	assert.Equal(t, []string{"/", "/org"}, results)
+}
 
-				if !r.Swap([]byte("test-key"), Bytes("test-value"), Bytes(val)) {
-					atomic.AddInt64(&failures, 1)
-				}
+func TestCursor(t *testing.T) {
+	keys := []string{
+		"a", "ab", "abc", "abd", "abde", "b", "ba", "bab", "test", "test1000",
+		"test1234", "tomato", "todo", "todos", "tamale", "z", "zz", "zzz",
+	}
 
-				wg.Done()
-			}(i)
-		}
+	r := New()
 
-		wg.Wait()
+	c := r.Cursor()
+	assert.False(t, c.First())
+	assert.False(t, c.Last())
+	assert.False(t, c.Valid())
 
-		assert.Equal(t, int64(w-1), failures)
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
 	}
+
+	sort.Strings(keys)
+
+	c = r.Cursor()
+
+	var results []string
+
+	for ok := c.First(); ok; ok = c.Next() {
+		assert.Equal(t, String(c.Key()), c.Value())
+		results = append(results, string(c.Key()))
+	}
+
+	assert.Equal(t, keys, results)
+	assert.False(t, c.Valid())
+	assert.Nil(t, c.Key())
+	assert.Nil(t, c.Value())
+
+	results = nil
+
+	for ok := c.Last(); ok; ok = c.Prev() {
+		results = append([]string{string(c.Key())}, results...)
+	}
+
+	assert.Equal(t, keys, results)
+
+	seeks := []struct {
+		Key   string
+		Found string
+	}{
+		{"", "a"},
+		{"a", "a"},
+		{"aa", "ab"},
+		{"abcd", "abd"},
+		{"bb", "tamale"},
+		{"test", "test"},
+		{"test1", "test1000"},
+		{"test12345", "todo"},
+		{"tomatoes", "z"},
+		{"zzz", "zzz"},
+		{"zzzz", ""},
+	}
+
+	for _, s := range seeks {
+		if s.Found == "" {
+			assert.False(t, c.Seek([]byte(s.Key)))
+			continue
+		}
+
+		require.True(t, c.Seek([]byte(s.Key)), s.Key)
+		assert.Equal(t, s.Found, string(c.Key()))
+	}
+
+	// change direction part way through
+	require.True(t, c.Seek([]byte("test1")))
+	require.True(t, c.Prev())
+	assert.Equal(t, "test", string(c.Key()))
+	require.True(t, c.Prev())
+	assert.Equal(t, "tamale", string(c.Key()))
+	require.True(t, c.Next())
+	assert.Equal(t, "test", string(c.Key()))
+	require.True(t, c.Next())
+	assert.Equal(t, "test1000", string(c.Key()))
+
+	require.True(t, c.First())
+	assert.False(t, c.Prev())
+}
+
+func TestSnapshot(t *testing.T) {
+	r := New()
+
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"}
+
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
+	}
+
+	s := r.Snapshot()
+	defer s.Release()
+
+	r.Insert([]byte("test"), String("updated"))
+	r.Insert([]byte("te"), String("te"))
+	r.Insert([]byte("test12"), String("test12"))
+	r.Insert([]byte("zebra"), String("zebra"))
+	r.Delete([]byte("todo"))
+	r.DeletePrefix([]byte("tom"))
+
+	for _, k := range keys {
+		assert.Equal(t, String(k), s.Lookup([]byte(k)), k)
+	}
+
+	assert.Nil(t, s.Lookup([]byte("te")))
+	assert.Nil(t, s.Lookup([]byte("test12")))
+	assert.Nil(t, s.Lookup([]byte("zebra")))
+
+	assert.Equal(t, String("updated"), r.Lookup([]byte("test")))
+	assert.Nil(t, r.Lookup([]byte("todo")))
+	assert.Nil(t, r.Lookup([]byte("tomato")))
+
+	sort.Strings(keys)
+
+	var iterated []string
+
+	s.Iterate(nil, func(key []byte, value Comparable) {
+		iterated = append(iterated, string(key))
+	})
+
+	assert.Equal(t, keys, iterated)
+
+	iterated = nil
+
+	s.RangeReverse(nil, nil, func(key []byte, value Comparable) bool {
+		iterated = append([]string{string(key)}, iterated...)
+		return true
+	})
+
+	assert.Equal(t, keys, iterated)
+
+	c := s.Cursor()
+
+	for i, k := range keys {
+		if i == 0 {
+			require.True(t, c.First())
+		} else {
+			require.True(t, c.Next())
+		}
+
+		assert.Equal(t, k, string(c.Key()))
+	}
+
+	assert.False(t, c.Next())
+
+	key, _, ok := s.Max()
+	require.True(t, ok)
+	assert.Equal(t, "tomato", string(key))
+
+	key, _, ok = s.Ceiling([]byte("test11"))
+	require.True(t, ok)
+	assert.Equal(t, "test1234", string(key))
+}
+
+func TestSnapshotRelease(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("test"), String("test"))
+
+	s := r.Snapshot()
+
+	r.Insert([]byte("abalienate"), String("abalienate"))
+
+	e, ok := r.root.getEdges().(*edgesVersion)
+	require.True(t, ok)
+	assert.True(t, e.previous != nil)
+
+	s.Release()
+	s.Release()
+
+	// previous versions should be dropped as soon as the snapshot is released,
+	// without waiting for the node to be changed again
+	assert.True(t, e.previous == nil)
+
+	// with no snapshots in use, new versions should not be kept
+	r.Insert([]byte("tomato"), String("tomato"))
+
+	_, ok = r.root.getEdges().(*edgesVersion)
+	assert.False(t, ok)
+
+	r.Insert([]byte("todo"), String("todo"))
+
+	_, ok = r.root.next('t').getEdges().(*edgesVersion)
+	assert.False(t, ok)
+}
+
+func TestSnapshotReleasedVersion(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("test"), String("test"))
+
+	s := r.Snapshot()
+
+	r.Insert([]byte("tomato"), String("tomato"))
+
+	s.Release()
+
+	// reading from a snapshot after it's been released would
+	// otherwise see the versions it needs as being empty
+	assert.Panics(t, func() {
+		s.Lookup([]byte("test"))
+	})
+}
+
+func TestConcurrentSnapshot(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 8
+	n := 2000
+
+	r := New()
+
+	// the number of keys each writer has inserted
+	inserted := make([]int64, w)
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < n; x++ {
+				key := []byte(fmt.Sprintf("%d-%d", b, x))
+				r.Insert(key, Bytes(key))
+
+				// delete the previous key of every other writer, so
+				// nodes are being merged while snapshots are taken
+				if b%2 == 0 && x > 0 {
+					r.Delete([]byte(fmt.Sprintf("%d-%d", b, x-1)))
+				}
+
+				atomic.StoreInt64(&inserted[b], int64(x+1))
+			}
+			wg.Done()
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		counts := make([]int64, w)
+
+		for b := range counts {
+			counts[b] = atomic.LoadInt64(&inserted[b])
+		}
+
+		s := r.Snapshot()
+
+		var first []string
+
+		s.Iterate(nil, func(key []byte, value Comparable) {
+			first = append(first, string(key))
+		})
+
+		// every insert that completed before the snapshot should be visible
+		for b, c := range counts {
+			if c < 1 {
+				continue
+			}
+
+			key := []byte(fmt.Sprintf("%d-%d", b, c-1))
+			value := s.Lookup(key)
+
+			if b%2 == 0 {
+				// the key may have been deleted by the writer before the snapshot was
+				// taken, once it had inserted a later key, which may also have been
+				// deleted since. the writer's newest key is never deleted though
+				if value == nil {
+					var later bool
+
+					for _, k := range first {
+						var kb, kx int64
+						fmt.Sscanf(k, "%d-%d", &kb, &kx)
+						later = later || int(kb) == b && kx >= c
+					}
+
+					require.True(t, later, string(key))
+				}
+				continue
+			}
+
+			require.NotNil(t, value, string(key))
+		}
+
+		runtime.Gosched()
+
+		var second []string
+
+		s.Iterate(nil, func(key []byte, value Comparable) {
+			second = append(second, string(key))
+		})
+
+		require.Equal(t, first, second)
+
+		s.Release()
+	}
+
+	wg.Wait()
+}
+
+func TestConcurrentSnapshotStable(t *testing.T) {
+	var readers, writers sync.WaitGroup
+	var done, missed int32
+
+	w := 4
+	n := 100
+
+	r := New()
+
+	// keys that never change while the tree is changed around them
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%03d-s", i))
+		r.Insert(key, Bytes(key))
+	}
+
+	writers.Add(w)
+
+	// add and remove siblings of the stable keys, so the
+	// nodes above them are continually split and merged
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for atomic.LoadInt32(&done) == 0 {
+				for x := 0; x < n; x++ {
+					key := []byte(fmt.Sprintf("%03d-%d", x, b))
+					r.Insert(key, Bytes(key))
+					r.Delete(key)
+					runtime.Gosched()
+				}
+			}
+			writers.Done()
+		}(i)
+	}
+
+	readers.Add(2)
+
+	// take and release snapshots, so the oldest version in use
+	// changes while the writers are publishing new versions
+	for i := 0; i < 2; i++ {
+		go func() {
+			for x := 0; x < 200; x++ {
+				s := r.Snapshot()
+
+				for y := 0; y < n*4; y++ {
+					if s.Lookup([]byte(fmt.Sprintf("%03d-s", y%n))) == nil {
+						atomic.AddInt32(&missed, 1)
+					}
+
+					// let the writers run while the snapshot is in use
+					if y%10 == 0 {
+						runtime.Gosched()
+					}
+				}
+
+				s.Release()
+
+				// leave gaps with no snapshots in use
+				runtime.Gosched()
+			}
+			readers.Done()
+		}()
+	}
+
+	readers.Wait()
+	atomic.StoreInt32(&done, 1)
+	writers.Wait()
+
+	assert.Zero(t, atomic.LoadInt32(&missed), "snapshots missed stable keys")
+}
+
+func TestConcurrentInsert(t *testing.T) {
+	var wg sync.WaitGroup
+
+	r := New()
+
+	batch := make([][][]byte, 1)
+
+	for i := 0; i < 1; i++ {
+		batch[i] = make([][]byte, 1000)
+
+		for x := 0; x < 1000; x++ {
+			batch[i][x] = []byte(uuid.New().String())
+		}
+	}
+
+	wg.Add(1)
+
+	for i := 0; i < 1; i++ {
+		go func(b int) {
+			for x := range batch[b] {
+				success := r.Insert(batch[b][x], Bytes(batch[b][x]))
+				if !success {
+					panic("failed to insert unique value")
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 1; i++ {
+		for x := 0; x < 1000; x++ {
+			value := r.Lookup(batch[i][x])
+			require.NotNil(t, value)
+			assert.True(t, bytes.Equal(value.(Bytes), batch[i][x]))
+		}
+	}
+}
+
+func TestConcurrentInsertInt(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 32
+
+	r := New()
+
+	batch := make([][][]byte, w)
+
+	for i := 0; i < w; i++ {
+		batch[i] = make([][]byte, 10000)
+
+		for x := 0; x < 10000; x++ {
+			batch[i][x] = []byte(strconv.Itoa(x))
+		}
+	}
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := range batch[b] {
+				r.Insert(batch[b][x], Bytes(batch[b][x]))
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for x := 0; x < 1000; x++ {
+		value := r.Lookup(batch[0][x])
+		require.NotNil(t, value)
+		assert.True(t, bytes.Equal(value.(Bytes), batch[0][x]))
+	}
+}
+
+func TestSwap(t *testing.T) {
+	uuids := make([][]byte, 10000)
+
+	for i := 0; i < 10000; i++ {
+		uuids[i] = []byte(uuid.New().String())
+	}
+
+	r := New()
+
+	// swap empty
+	for x := 0; x < 10000; x++ {
+		success := r.Swap(uuids[x], nil, Bytes(uuids[x]))
+		require.True(t, success)
+	}
+
+	v := []byte("new-value")
+
+	// swap existing
+	for x := 0; x < 10000; x++ {
+		success := r.Swap(uuids[x], Bytes(uuids[x]), Bytes(v))
+		require.True(t, success)
+	}
+
+	// test swapping a value that has been inserted, but its value is nil
+	r.Insert([]byte("hello"), nil)
+	success := r.Swap([]byte("hello"), nil, String("HELLO"))
+	require.True(t, success)
+}
+
+func TestConcurrentSwap(t *testing.T) {
+	for x := 0; x < 100; x++ {
+		var wg sync.WaitGroup
+		var failures int64
+
+		w := 32
+
+		r := New()
+
+		wg.Add(w)
+
+		for i := 0; i < w; i++ {
+			go func(b int) {
+				val := fmt.Sprintf("test-value-%d", b)
+
+				if !r.Swap([]byte("test-key"), nil, Bytes(val)) {
+					atomic.AddInt64(&failures, 1)
+				}
+
+				wg.Done()
+			}(i)
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, int64(w-1), failures)
+	}
+
+	for x := 0; x < 100; x++ {
+		var wg sync.WaitGroup
+		var failures int64
+
+		w := 32
+
+		r := New()
+
+		wg.Add(w)
+
+		r.Insert([]byte("test-key"), Bytes("test-value"))
+
+		for i := 0; i < w; i++ {
+			go func(b int) {
+				val := fmt.Sprintf("test-value-%d", b)
+
+				if !r.Swap([]byte("test-key"), Bytes("test-value"), Bytes(val)) {
+					atomic.AddInt64(&failures, 1)
+				}
+
+				wg.Done()
+			}(i)
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, int64(w-1), failures)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Existing []string
+		Deletes  []string
+		Missing  []string
+	}{
+		{
+			"simple",
+			[]string{"test"},
+			[]string{"test"},
+			[]string{"test1234"},
+		},
+		{
+			"leaf",
+			[]string{"test", "test1234", "test1000"},
+			[]string{"test1234"},
+			[]string{"test12", "test5678"},
+		},
+		{
+			"inner",
+			[]string{"test", "test1234", "test1000"},
+			[]string{"test"},
+			[]string{"tes", "test1"},
+		},
+		{
+			"merge",
+			[]string{"test", "test1234"},
+			[]string{"test"},
+			[]string{"t", "test12"},
+		},
+		{
+			"merge-split",
+			[]string{"tomato", "todo", "todos", "tamale"},
+			[]string{"tomato", "todo"},
+			[]string{"to", "tod"},
+		},
+		{
+			"all",
+			[]string{"abalienate", "abalienated", "abalienating"},
+			[]string{"abalienated", "abalienating", "abalienate"},
+			[]string{"abalienat"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := New()
+
+			for _, k := range tc.Existing {
+				r.Insert([]byte(k), String(k))
+			}
+
+			deleted := make(map[string]bool)
+
+			for _, k := range tc.Deletes {
+				require.True(t, r.Delete([]byte(k)))
+				require.False(t, r.Delete([]byte(k)))
+				deleted[k] = true
+			}
+
+			for _, k := range tc.Existing {
+				if deleted[k] {
+					assert.Nil(t, r.Lookup([]byte(k)))
+					continue
+				}
+
+				assert.Equal(t, String(k), r.Lookup([]byte(k)))
+			}
+
+			for _, k := range tc.Missing {
+				assert.Nil(t, r.Lookup([]byte(k)))
+				assert.False(t, r.Delete([]byte(k)))
+			}
+		})
+	}
+}
+
+func TestDeleteShrink(t *testing.T) {
+	r := New()
+
+	for i := 0; i < 256; i++ {
+		r.Insert([]byte{'k', byte(i)}, Bytes{byte(i)})
+	}
+
+	n := r.root.next('k')
+	require.NotNil(t, n)
+	assert.Equal(t, uint8(Node256), n.getEdges().ntype())
+	assert.Equal(t, 256, n.getEdges().count())
+
+	for i := 0; i < 255; i++ {
+		require.True(t, r.Delete([]byte{'k', byte(i)}))
+	}
+
+	// the last remaining key should have been merged into its parent
+	n = r.root.next('k')
+	require.NotNil(t, n)
+	assert.Equal(t, []byte{255}, n.prefix)
+	assert.Equal(t, uint8(NodeLeaf), n.getEdges().ntype())
+	assert.Equal(t, Bytes{255}, r.Lookup([]byte{'k', 255}))
+
+	require.True(t, r.Delete([]byte{'k', 255}))
+	assert.Nil(t, r.root.next('k'))
+}
+
+func TestConcurrentDelete(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 32
+
+	r := New()
+
+	keys := make([][]byte, 10000)
+
+	for i := range keys {
+		keys[i] = []byte(uuid.New().String())
+		r.Insert(keys[i], Bytes(keys[i]))
+	}
+
+	var deleted int64
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := range keys {
+				// delete every other key while re-inserting the rest
+				if x%2 == 0 {
+					if r.Delete(keys[x]) {
+						atomic.AddInt64(&deleted, 1)
+					}
+				} else {
+					r.Insert(keys[x], Bytes(keys[x]))
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int64(len(keys)/2), deleted)
+
+	for x := range keys {
+		if x%2 == 0 {
+			assert.Nil(t, r.Lookup(keys[x]))
+			continue
+		}
+
+		value := r.Lookup(keys[x])
+		require.NotNil(t, value)
+		assert.True(t, bytes.Equal(value.(Bytes), keys[x]))
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"}
+
+	cases := []struct {
+		Prefix  string
+		Removed []string
+	}{
+		{"test", []string{"test", "test1000", "test1234"}},
+		{"test1", []string{"test1000", "test1234"}},
+		{"test12", []string{"test1234"}},
+		{"tod", []string{"todo", "todos"}},
+		{"t", []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale"}},
+		{"", keys},
+		{"test5", nil},
+		{"x", nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Prefix, func(t *testing.T) {
+			r := New()
+
+			for _, k := range keys {
+				r.Insert([]byte(k), String(k))
+			}
+
+			assert.Equal(t, len(tc.Removed), r.DeletePrefix([]byte(tc.Prefix)))
+			assert.Equal(t, len(keys)-len(tc.Removed), r.Len())
+
+			removed := make(map[string]bool)
+
+			for _, k := range tc.Removed {
+				removed[k] = true
+			}
+
+			for _, k := range keys {
+				if removed[k] {
+					assert.Nil(t, r.Lookup([]byte(k)), k)
+					continue
+				}
+
+				assert.Equal(t, String(k), r.Lookup([]byte(k)), k)
+			}
+
+			assert.Equal(t, 0, r.CountPrefix([]byte(tc.Prefix)))
+			assertSizes(t, r)
+
+			// the tree should still be usable afterwards
+			for _, k := range keys {
+				r.Insert([]byte(k), String(k))
+			}
+
+			assert.Equal(t, len(keys), r.Len())
+			assertSizes(t, r)
+		})
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"}
+
+	sort.Strings(keys)
+
+	cases := []struct {
+		Start string
+		End   string
+	}{
+		{"", ""},
+		{"t", ""},
+		{"", "t"},
+		{"test", "test2"},
+		{"test1", "todos"},
+		{"tamale", "tamale"},
+		{"abc", "test1234"},
+		{"todo", "tomatoes"},
+		{"u", "z"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Start+"-"+tc.End, func(t *testing.T) {
+			r := New()
+
+			for _, k := range keys {
+				r.Insert([]byte(k), String(k))
+			}
+
+			var expected []string
+
+			for _, k := range keys {
+				if k < tc.Start || tc.End != "" && k >= tc.End {
+					expected = append(expected, k)
+				}
+			}
+
+			removed := r.DeleteRange([]byte(tc.Start), []byte(tc.End))
+			assert.Equal(t, len(keys)-len(expected), removed)
+			assert.Equal(t, len(expected), r.Len())
+
+			var remaining []string
+
+			r.Iterate(nil, func(key []byte, value Comparable) {
+				remaining = append(remaining, string(key))
+			})
+
+			assert.Equal(t, expected, remaining)
+			assertSizes(t, r)
+		})
+	}
+}
+
+func TestConcurrentDeletePrefix(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 16
+
+	r := New()
+
+	prefixes := make([][]byte, 64)
+
+	for i := range prefixes {
+		prefixes[i] = []byte(fmt.Sprintf("tenant/%d/", i))
+	}
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < 2000; x++ {
+				p := prefixes[(x*7+b)%len(prefixes)]
+
+				if x%50 == 0 {
+					r.DeletePrefix(p)
+					continue
+				}
+
+				key := append([]byte(string(p)), strconv.Itoa(x)...)
+				r.Insert(key, Bytes(key))
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	var count int
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		count++
+	})
+
+	assert.Equal(t, count, r.Len())
+	assertSizes(t, r)
+
+	assert.Equal(t, count, r.DeletePrefix([]byte("tenant/")))
+	assert.Equal(t, 0, r.Len())
+	assertSizes(t, r)
+}
+
+func TestConcurrentDeletePrefixUpdate(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 8
+
+	r := New()
+
+	prefixes := make([][]byte, 16)
+
+	for i := range prefixes {
+		prefixes[i] = []byte(fmt.Sprintf("tenant/%d/", i))
+	}
+
+	wg.Add(w)
+
+	// keys are found before their values are compared, so a prefix can be removed
+	// between the two. the writes must not be lost in the subtree that was removed
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < 2000; x++ {
+				p := prefixes[(x*7+b)%len(prefixes)]
+				key := append([]byte(string(p)), strconv.Itoa(x%20)...)
+
+				switch x % 4 {
+				case 0:
+					if x%40 == 0 {
+						r.DeletePrefix(p)
+					}
+				case 1:
+					r.Update(key, func(old Comparable, exists bool) (Comparable, bool) {
+						return Bytes(key), false
+					})
+				case 2:
+					r.CompareAndDelete(key, Bytes(key))
+				case 3:
+					r.Swap(key, nil, Bytes(key))
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	var count int
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		count++
+	})
+
+	assert.Equal(t, count, r.Len())
+	assertSizes(t, r)
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("lease"), String("owner-1"))
+
+	assert.False(t, r.CompareAndDelete([]byte("lease"), String("owner-2")))
+	assert.False(t, r.CompareAndDelete([]byte("lease"), nil))
+	assert.False(t, r.CompareAndDelete([]byte("missing"), String("owner-1")))
+	assert.Equal(t, String("owner-1"), r.Lookup([]byte("lease")))
+
+	assert.True(t, r.CompareAndDelete([]byte("lease"), String("owner-1")))
+	assert.Nil(t, r.Lookup([]byte("lease")))
+	assert.False(t, r.CompareAndDelete([]byte("lease"), String("owner-1")))
+}
+
+func TestConcurrentCompareAndDelete(t *testing.T) {
+	for x := 0; x < 100; x++ {
+		var wg sync.WaitGroup
+		var failures int64
+
+		w := 32
+
+		r := New()
+
+		r.Insert([]byte("test-key"), Bytes("test-value"))
+		r.Insert([]byte("test-key-2"), Bytes("test-value"))
+
+		wg.Add(w)
+
+		for i := 0; i < w; i++ {
+			go func(b int) {
+				if !r.CompareAndDelete([]byte("test-key"), Bytes("test-value")) {
+					atomic.AddInt64(&failures, 1)
+				}
+
+				wg.Done()
+			}(i)
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, int64(w-1), failures)
+		assert.Nil(t, r.Lookup([]byte("test-key")))
+		assert.Equal(t, Bytes("test-value"), r.Lookup([]byte("test-key-2")))
+	}
+}
+
+func TestLoadOrStore(t *testing.T) {
+	r := New()
+
+	actual, loaded := r.LoadOrStore([]byte("test"), String("1234"))
+	assert.False(t, loaded)
+	assert.Equal(t, String("1234"), actual)
+
+	actual, loaded = r.LoadOrStore([]byte("test"), String("5678"))
+	assert.True(t, loaded)
+	assert.Equal(t, String("1234"), actual)
+
+	// keys that split an existing node should still be stored
+	actual, loaded = r.LoadOrStore([]byte("te"), String("5678"))
+	assert.False(t, loaded)
+	assert.Equal(t, String("5678"), actual)
+
+	value, loaded := r.LoadAndDelete([]byte("test"))
+	assert.True(t, loaded)
+	assert.Equal(t, String("1234"), value)
+
+	value, loaded = r.LoadAndDelete([]byte("test"))
+	assert.False(t, loaded)
+	assert.Nil(t, value)
+
+	assert.Nil(t, r.Lookup([]byte("test")))
+	assert.Equal(t, String("5678"), r.Lookup([]byte("te")))
+}
+
+func TestConcurrentLoadOrStore(t *testing.T) {
+	for x := 0; x < 100; x++ {
+		var wg sync.WaitGroup
+		var stored int64
+
+		w := 32
+
+		r := New()
+
+		results := make([]Comparable, w)
+
+		wg.Add(w)
+
+		for i := 0; i < w; i++ {
+			go func(b int) {
+				actual, loaded := r.LoadOrStore([]byte("test-key"), Bytes(fmt.Sprintf("test-value-%d", b)))
+				if !loaded {
+					atomic.AddInt64(&stored, 1)
+				}
+
+				results[b] = actual
+
+				wg.Done()
+			}(i)
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, int64(1), stored)
+
+		for i := range results {
+			assert.Equal(t, r.Lookup([]byte("test-key")), results[i])
+		}
+	}
+}
+
+type counter int64
+
+func (c counter) EqualTo(v interface{}) bool {
+	cv, ok := v.(counter)
+	if !ok {
+		return false
+	}
+
+	return c == cv
+}
+
+func TestUpdate(t *testing.T) {
+	r := New()
+
+	increment := func(old Comparable, exists bool) (Comparable, bool) {
+		if !exists {
+			return counter(1), false
+		}
+		return old.(counter) + 1, false
+	}
+
+	assert.Equal(t, counter(1), r.Update([]byte("counter"), increment))
+	assert.Equal(t, counter(2), r.Update([]byte("counter"), increment))
+	assert.Equal(t, counter(1), r.Update([]byte("count"), increment))
+	assert.Equal(t, counter(2), r.Lookup([]byte("counter")))
+
+	remove := func(old Comparable, exists bool) (Comparable, bool) {
+		return nil, true
+	}
+
+	assert.Nil(t, r.Update([]byte("counter"), remove))
+	assert.Nil(t, r.Lookup([]byte("counter")))
+	assert.Nil(t, r.Update([]byte("missing"), remove))
+	assert.Equal(t, counter(1), r.Lookup([]byte("count")))
+
+	// returning a nil value deletes the key, without leaving a node behind for it
+	clear := func(old Comparable, exists bool) (Comparable, bool) {
+		return nil, false
+	}
+
+	r.Insert([]byte("counters"), counter(5))
+
+	assert.Nil(t, r.Update([]byte("count"), clear))
+	assert.Nil(t, r.Update([]byte("missing"), clear))
+	assert.Nil(t, r.Lookup([]byte("count")))
+	assert.Equal(t, counter(5), r.Lookup([]byte("counters")))
+	assert.Equal(t, 1, r.Len())
+
+	parent, current, pos, dv := r.find([]byte("count"))
+	assert.False(t, current != nil && shouldUpdate([]byte("count"), current, parent, pos, dv))
+
+	assertSizes(t, r)
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 32
+
+	r := New()
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < 1000; x++ {
+				r.Update([]byte(strconv.Itoa(x%10)), func(old Comparable, exists bool) (Comparable, bool) {
+					if !exists {
+						return counter(1), false
+					}
+					return old.(counter) + 1, false
+				})
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for x := 0; x < 10; x++ {
+		assert.Equal(t, counter(w*100), r.Lookup([]byte(strconv.Itoa(x))))
+	}
+}
+
+func TestTxn(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("alice"), counter(100))
+	r.Insert([]byte("bob"), counter(50))
+	r.Insert([]byte("carol"), counter(10))
+
+	tx := r.Txn()
+
+	assert.Equal(t, counter(100), tx.Get([]byte("alice")))
+	assert.Nil(t, tx.Get([]byte("dave")))
+
+	tx.Put([]byte("alice"), counter(70))
+	tx.Put([]byte("bob"), counter(80))
+	tx.Put([]byte("dave"), counter(1))
+	tx.Delete([]byte("carol"))
+
+	// changes are visible to the transaction, but not the tree
+	assert.Equal(t, counter(70), tx.Get([]byte("alice")))
+	assert.Equal(t, counter(1), tx.Get([]byte("dave")))
+	assert.Nil(t, tx.Get([]byte("carol")))
+	assert.Equal(t, counter(100), r.Lookup([]byte("alice")))
+	assert.Equal(t, counter(10), r.Lookup([]byte("carol")))
+
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, ErrTxnDone, tx.Commit())
+
+	assert.Equal(t, counter(70), r.Lookup([]byte("alice")))
+	assert.Equal(t, counter(80), r.Lookup([]byte("bob")))
+	assert.Equal(t, counter(1), r.Lookup([]byte("dave")))
+	assert.Nil(t, r.Lookup([]byte("carol")))
+	assert.Equal(t, 3, r.Len())
+
+	tx = r.Txn()
+	tx.Put([]byte("erin"), counter(5))
+	tx.Discard()
+
+	assert.Equal(t, ErrTxnDone, tx.Commit())
+	assert.Nil(t, r.Lookup([]byte("erin")))
+}
+
+func TestTxnConflict(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("alice"), counter(100))
+	r.Insert([]byte("bob"), counter(50))
+
+	// a key that was read has changed
+	tx := r.Txn()
+	tx.Get([]byte("alice"))
+	tx.Put([]byte("bob"), counter(0))
+
+	r.Insert([]byte("alice"), counter(101))
+
+	assert.Equal(t, ErrConflict, tx.Commit())
+	assert.Equal(t, counter(50), r.Lookup([]byte("bob")))
+
+	// a key that was written has been created
+	tx = r.Txn()
+	tx.Put([]byte("carol"), counter(1))
+
+	r.Insert([]byte("carol"), counter(2))
+
+	assert.Equal(t, ErrConflict, tx.Commit())
+	assert.Equal(t, counter(2), r.Lookup([]byte("carol")))
+
+	// a key that was written has been deleted
+	tx = r.Txn()
+	tx.Put([]byte("bob"), counter(51))
+
+	r.Delete([]byte("bob"))
+
+	assert.Equal(t, ErrConflict, tx.Commit())
+	assert.Nil(t, r.Lookup([]byte("bob")))
+
+	// the first of two transactions to commit wins
+	tx1 := r.Txn()
+	tx2 := r.Txn()
+
+	tx1.Put([]byte("alice"), counter(tx1.Get([]byte("alice")).(counter)+1))
+	tx2.Put([]byte("alice"), counter(tx2.Get([]byte("alice")).(counter)+1))
+
+	require.Nil(t, tx1.Commit())
+	assert.Equal(t, ErrConflict, tx2.Commit())
+	assert.Equal(t, counter(102), r.Lookup([]byte("alice")))
+}
+
+func TestTxnStaged(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("alice"), counter(100))
+	r.Insert([]byte("bob"), counter(50))
+
+	s := r.Snapshot()
+	defer s.Release()
+
+	tx := r.Txn()
+
+	tx.Put([]byte("alice"), counter(90))
+	tx.Put([]byte("bob"), counter(60))
+	tx.Put([]byte("carol"), counter(10))
+
+	keys := []string{"alice", "bob", "carol"}
+
+	c := &commit{version: uncommitted}
+	staged := &ART{root: r.root, clock: r.clock, txn: c, gen: r.gen}
+
+	w := r.clock.begin()
+	w.txn = c
+
+	require.True(t, tx.hold(staged, keys, &w))
+	require.True(t, tx.stage(staged, keys, &w))
+
+	// staged changes are only visible to the transaction
+	assert.Equal(t, counter(90), staged.Lookup([]byte("alice")))
+	assert.Equal(t, counter(10), staged.Lookup([]byte("carol")))
+	assert.Equal(t, counter(100), r.Lookup([]byte("alice")))
+	assert.Equal(t, counter(50), r.Lookup([]byte("bob")))
+	assert.Nil(t, r.Lookup([]byte("carol")))
+	assert.Equal(t, counter(100), s.Lookup([]byte("alice")))
+
+	// another transaction using the same keys fails
+	o := &commit{version: uncommitted}
+	ow := w
+	ow.txn = o
+
+	assert.False(t, tx.hold(&ART{root: r.root, clock: r.clock, txn: o, gen: r.gen}, keys, &ow))
+
+	// aborting removes every staged change
+	c.abort()
+	r.clock.end(&w)
+
+	assert.Equal(t, counter(100), r.Lookup([]byte("alice")))
+	assert.Nil(t, r.Lookup([]byte("carol")))
+	assert.Equal(t, 2, r.Len())
+
+	require.Nil(t, tx.Commit())
+
+	assert.Equal(t, counter(90), r.Lookup([]byte("alice")))
+	assert.Equal(t, counter(60), r.Lookup([]byte("bob")))
+	assert.Equal(t, counter(10), r.Lookup([]byte("carol")))
+	assert.Equal(t, 3, r.Len())
+
+	// the snapshot still sees none of the changes
+	assert.Equal(t, counter(100), s.Lookup([]byte("alice")))
+	assert.Equal(t, counter(50), s.Lookup([]byte("bob")))
+	assert.Nil(t, s.Lookup([]byte("carol")))
+}
+
+func TestConcurrentTxn(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 16
+	accounts := 10
+
+	r := New()
+
+	for i := 0; i < accounts; i++ {
+		r.Insert([]byte(fmt.Sprintf("account-%d", i)), counter(100))
+	}
+
+	var committed int64
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < 500; x++ {
+				from := []byte(fmt.Sprintf("account-%d", (x+b)%accounts))
+				to := []byte(fmt.Sprintf("account-%d", (x*7+b+1)%accounts))
+
+				if bytes.Equal(from, to) {
+					continue
+				}
+
+				tx := r.Txn()
+
+				tx.Put(from, tx.Get(from).(counter)-1)
+				tx.Put(to, tx.Get(to).(counter)+1)
+
+				if tx.Commit() == nil {
+					atomic.AddInt64(&committed, 1)
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+
+	// every snapshot should see the same total balance
+	for i := 0; i < 100; i++ {
+		var total counter
+
+		s := r.Snapshot()
+
+		s.Iterate(nil, func(key []byte, value Comparable) {
+			total = total + value.(counter)
+		})
+
+		s.Release()
+
+		require.Equal(t, counter(accounts*100), total)
+	}
+
+	wg.Wait()
+
+	var total counter
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		total = total + value.(counter)
+	})
+
+	assert.Equal(t, counter(accounts*100), total)
+	assert.True(t, committed > 0)
+}
+
+func TestBulkLoad(t *testing.T) {
+	keys := []string{"abalienate", "tamale", "test", "test1000", "test1234", "todo", "todos", "tomato"}
+
+	for i := 0; i < 256; i++ {
+		keys = append(keys, "wide"+string([]byte{byte(i)}))
+	}
+
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("x%02d", i))
+	}
+
+	for i := 0; i < 30; i++ {
+		keys = append(keys, "y"+string([]byte{byte(i)}))
+	}
+
+	sort.Strings(keys)
+
+	r := New()
+
+	var i int
+
+	err := r.BulkLoad(func() ([]byte, Comparable, bool) {
+		if i == len(keys) {
+			return nil, nil, false
+		}
+
+		i++
+
+		return []byte(keys[i-1]), String(keys[i-1]), true
+	})
+
+	require.Nil(t, err)
+	assert.Equal(t, len(keys), r.Len())
+	assertSizes(t, r)
+
+	for _, k := range keys {
+		assert.Equal(t, String(k), r.Lookup([]byte(k)), k)
+	}
+
+	var iterated []string
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		iterated = append(iterated, string(key))
+	})
+
+	assert.Equal(t, keys, iterated)
+
+	// nodes should be created with the right size of edges
+	n := r.root.next('w')
+	require.NotNil(t, n)
+	assert.Equal(t, uint8(Node256), n.getEdges().ntype())
+
+	n = r.root.next('x')
+	require.NotNil(t, n)
+	assert.Equal(t, uint8(Node4), n.getEdges().ntype())
+	assert.Equal(t, uint8(Node16), n.next('0').getEdges().ntype())
+	assert.Equal(t, uint8(Node16), n.next('1').getEdges().ntype())
+
+	n = r.root.next('y')
+	require.NotNil(t, n)
+	assert.Equal(t, uint8(Node48), n.getEdges().ntype())
+}
+
+func TestBulkLoadExisting(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("test"), String("existing"))
+	r.Insert([]byte("test1234"), String("existing"))
+	r.Insert([]byte("tomato"), String("existing"))
+
+	keys := []string{"abalienate", "tamale", "test", "test1000", "test12", "todo", "todos"}
+
+	var i int
+
+	err := r.BulkLoad(func() ([]byte, Comparable, bool) {
+		if i == len(keys) {
+			return nil, nil, false
+		}
+
+		i++
+
+		return []byte(keys[i-1]), String(keys[i-1]), true
+	})
+
+	require.Nil(t, err)
+	assert.Equal(t, len(keys)+2, r.Len())
+	assertSizes(t, r)
+
+	for _, k := range keys {
+		assert.Equal(t, String(k), r.Lookup([]byte(k)), k)
+	}
+
+	assert.Equal(t, String("existing"), r.Lookup([]byte("test1234")))
+	assert.Equal(t, String("existing"), r.Lookup([]byte("tomato")))
+}
+
+func TestBulkLoadInvalid(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Keys  []string
+		Error error
+	}{
+		{"unsorted", []string{"test", "tomato", "tamale"}, ErrUnsorted},
+		{"duplicate", []string{"test", "test"}, ErrUnsorted},
+		{"empty", []string{"", "test"}, ErrEmptyKey},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			r := New()
+
+			var i int
+
+			err := r.BulkLoad(func() ([]byte, Comparable, bool) {
+				if i == len(tc.Keys) {
+					return nil, nil, false
+				}
+
+				i++
+
+				return []byte(tc.Keys[i-1]), String(tc.Keys[i-1]), true
+			})
+
+			assert.Equal(t, tc.Error, err)
+			assert.Equal(t, 0, r.Len())
+			assert.Nil(t, r.Lookup([]byte("test")))
+		})
+	}
+}
+
+func TestInsertBatch(t *testing.T) {
+	r := New()
+
+	for i := 0; i < 500; i++ {
+		k := uuid.New().String()[:6]
+		r.Insert([]byte(k), String(k))
+	}
+
+	keys := make([][]byte, 5000)
+	values := make([]Comparable, len(keys))
+
+	for i := range keys {
+		keys[i] = []byte(uuid.New().String()[:6])
+		values[i] = Bytes(keys[i])
+	}
+
+	// repeated keys should use the last value in the batch
+	keys = append(keys, keys[0])
+	values = append(values, String("last"))
+
+	require.Nil(t, r.InsertBatch(keys, values))
+
+	for i := 1; i < len(keys)-1; i++ {
+		if bytes.Equal(keys[i], keys[0]) {
+			continue
+		}
+
+		assert.Equal(t, Bytes(keys[i]), r.Lookup(keys[i]))
+	}
+
+	assert.Equal(t, String("last"), r.Lookup(keys[0]))
+
+	var count int
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		count++
+	})
+
+	assert.Equal(t, count, r.Len())
+	assertSizes(t, r)
+
+	assert.Equal(t, ErrBatchLength, r.InsertBatch(keys, values[1:]))
+	assert.Equal(t, ErrEmptyKey, r.InsertBatch([][]byte{{}}, []Comparable{String("empty")}))
+}
+
+func TestInsertBatchNil(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("existing"), String("existing"))
+
+	keys := [][]byte{[]byte("new"), []byte("existing"), []byte("nil"), []byte("repeated"), []byte("repeated")}
+	values := []Comparable{String("new"), nil, nil, String("first"), nil}
+
+	// keys with nil values are skipped, including when they're the last value for a key
+	require.Nil(t, r.InsertBatch(keys, values))
+
+	assert.Equal(t, String("new"), r.Lookup([]byte("new")))
+	assert.Equal(t, String("existing"), r.Lookup([]byte("existing")))
+	assert.Nil(t, r.Lookup([]byte("nil")))
+	assert.Nil(t, r.Lookup([]byte("repeated")))
+	assert.Equal(t, 2, r.Len())
+	assertSizes(t, r)
+}
+
+func TestClone(t *testing.T) {
+	r := New()
+
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"}
+
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
+	}
+
+	c := r.Clone()
+
+	assert.Equal(t, len(keys), c.Len())
+	assertSizes(t, c)
+
+	for _, k := range keys {
+		assert.Equal(t, String(k), c.Lookup([]byte(k)))
+	}
+
+	// changes to either tree should not affect the other
+	r.Insert([]byte("test"), String("original"))
+	r.Insert([]byte("te"), String("original"))
+	r.Delete([]byte("todo"))
+
+	c.Insert([]byte("tomato"), String("clone"))
+	c.Insert([]byte("test12"), String("clone"))
+	c.DeletePrefix([]byte("ab"))
+
+	assert.Equal(t, String("original"), r.Lookup([]byte("test")))
+	assert.Equal(t, String("original"), r.Lookup([]byte("te")))
+	assert.Nil(t, r.Lookup([]byte("todo")))
+	assert.Equal(t, String("tomato"), r.Lookup([]byte("tomato")))
+	assert.Nil(t, r.Lookup([]byte("test12")))
+	assert.Equal(t, String("abalienate"), r.Lookup([]byte("abalienate")))
+
+	assert.Equal(t, String("test"), c.Lookup([]byte("test")))
+	assert.Nil(t, c.Lookup([]byte("te")))
+	assert.Equal(t, String("todo"), c.Lookup([]byte("todo")))
+	assert.Equal(t, String("clone"), c.Lookup([]byte("tomato")))
+	assert.Equal(t, String("clone"), c.Lookup([]byte("test12")))
+	assert.Nil(t, c.Lookup([]byte("abalienate")))
+
+	assert.Equal(t, len(keys), r.Len())
+	assert.Equal(t, len(keys), c.Len())
+	assertSizes(t, r)
+	assertSizes(t, c)
+}
+
+func TestCloneShared(t *testing.T) {
+	r := New()
+
+	for _, k := range []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"} {
+		r.Insert([]byte(k), String(k))
+	}
+
+	s := r.Snapshot()
+	defer s.Release()
+
+	c := r.Clone()
+
+	// only the root is copied
+	assert.NotEqual(t, r.root, c.root)
+
+	for i := 0; i < 256; i++ {
+		assert.Equal(t, r.root.next(byte(i)), c.root.next(byte(i)))
+	}
+
+	tomato := func(t *ART) *node {
+		_, current, _, _ := t.find([]byte("tomato"))
+		return current
+	}
+
+	// the clone copies the nodes on the path to the keys it changes,
+	// leaving the nodes it shares with the original unchanged
+	shared := tomato(r)
+
+	c.Insert([]byte("test12"), String("clone"))
+	c.Delete([]byte("todo"))
+	c.Delete([]byte("todos"))
+
+	assert.Equal(t, shared, tomato(r))
+	assert.Equal(t, r.root.next('a'), c.root.next('a'))
+	assert.NotEqual(t, r.root.next('t'), c.root.next('t'))
+
+	// as does the original
+	r.Insert([]byte("tomato"), String("original"))
+
+	assert.NotEqual(t, shared, tomato(r))
+	assert.Equal(t, String("tomato"), c.Lookup([]byte("tomato")))
+	assert.Equal(t, String("original"), r.Lookup([]byte("tomato")))
+	assert.Equal(t, String("todo"), r.Lookup([]byte("todo")))
+	assert.Nil(t, r.Lookup([]byte("test12")))
+	assert.Nil(t, c.Lookup([]byte("todo")))
+
+	// the snapshot taken before the tree was cloned is unchanged
+	assert.Equal(t, String("tomato"), s.Lookup([]byte("tomato")))
+	assert.Nil(t, s.Lookup([]byte("test12")))
+	assert.Equal(t, String("todo"), s.Lookup([]byte("todo")))
+
+	// a clone of a clone
+	cc := c.Clone()
+	cc.DeletePrefix([]byte("te"))
+
+	assert.Equal(t, 7, c.Len())
+	assert.Equal(t, 3, cc.Len())
+	assert.Equal(t, String("clone"), c.Lookup([]byte("test12")))
+
+	assertSizes(t, r)
+	assertSizes(t, c)
+	assertSizes(t, cc)
+}
+
+func TestConcurrentClone(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 8
+
+	r := New()
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < 5000; x++ {
+				key := []byte(fmt.Sprintf("%d-%d", b, x%500))
+
+				if x%3 == 0 {
+					r.Delete(key)
+				} else {
+					r.Insert(key, Bytes(key))
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		s := r.Snapshot()
+		c := s.Clone()
+
+		var expected, cloned []string
+
+		s.Iterate(nil, func(key []byte, value Comparable) {
+			expected = append(expected, string(key))
+		})
+
+		c.Iterate(nil, func(key []byte, value Comparable) {
+			cloned = append(cloned, string(key))
+		})
+
+		s.Release()
+
+		require.Equal(t, expected, cloned)
+		assert.Equal(t, len(cloned), c.Len())
+		assertSizes(t, c)
+
+		runtime.Gosched()
+	}
+
+	wg.Wait()
+}
+
+func TestConcurrentCloneWrites(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 8
+
+	r := New()
+
+	for x := 0; x < 500; x++ {
+		key := []byte(fmt.Sprintf("key-%d", x))
+		r.Insert(key, Bytes(key))
+	}
+
+	stop := make(chan struct{})
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			defer wg.Done()
+
+			for x := 0; ; x++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key := []byte(fmt.Sprintf("key-%d", (x*w+b)%500))
+
+				switch x % 3 {
+				case 0:
+					r.Delete(key)
+				case 1:
+					r.Insert(key, String("changed"))
+				default:
+					r.Insert(key, Bytes(key))
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		c := r.Clone()
+
+		expected := make(map[string]Comparable)
+
+		c.Iterate(nil, func(key []byte, value Comparable) {
+			expected[string(key)] = value
+		})
+
+		require.Equal(t, len(expected), c.Len())
+
+		// change the clone while the original is being changed
+		var cw sync.WaitGroup
+
+		cw.Add(w)
+
+		for b := 0; b < w; b++ {
+			go func(b int) {
+				for x := b; x < 500; x += w {
+					key := []byte(fmt.Sprintf("key-%d", x))
+
+					c.Update(key, func(old Comparable, exists bool) (Comparable, bool) {
+						return String("clone"), x%2 == 0
+					})
+				}
+				cw.Done()
+			}(b)
+		}
+
+		cw.Wait()
+
+		for x := 0; x < 500; x++ {
+			key := fmt.Sprintf("key-%d", x)
+
+			if x%2 == 0 {
+				delete(expected, key)
+			} else {
+				expected[key] = String("clone")
+			}
+		}
+
+		found := make(map[string]Comparable)
+
+		c.Iterate(nil, func(key []byte, value Comparable) {
+			found[string(key)] = value
+		})
+
+		require.Equal(t, expected, found)
+		require.Equal(t, len(expected), c.Len())
+		assertSizes(t, c)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		require.NotEqual(t, String("clone"), value)
+	})
+
+	assertSizes(t, r)
+}
+
+func TestDiff(t *testing.T) {
+	type change struct {
+		key      string
+		old, new Comparable
+	}
+
+	a := New()
+	b := New()
+
+	for _, k := range []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"} {
+		a.Insert([]byte(k), String(k))
+		b.Insert([]byte(k), String(k))
+	}
+
+	b.Insert([]byte("te"), String("te"))
+	b.Insert([]byte("test12"), String("test12"))
+	b.Insert([]byte("todo"), String("changed"))
+	b.Delete([]byte("tomato"))
+	b.DeletePrefix([]byte("ab"))
+	b.Insert([]byte("zebra"), String("zebra"))
+
+	var changes []change
+
+	Diff(a, b, func(key []byte, old, new Comparable) {
+		changes = append(changes, change{string(key), old, new})
+	})
+
+	expected := []change{
+		{"abalienate", String("abalienate"), nil},
+		{"te", nil, String("te")},
+		{"test12", nil, String("test12")},
+		{"todo", String("todo"), String("changed")},
+		{"tomato", String("tomato"), nil},
+		{"zebra", nil, String("zebra")},
+	}
+
+	assert.Equal(t, expected, changes)
+
+	// the same changes in reverse
+	changes = nil
+
+	Diff(b, a, func(key []byte, old, new Comparable) {
+		changes = append(changes, change{string(key), old, new})
+	})
+
+	require.Len(t, changes, len(expected))
+
+	for i := range expected {
+		assert.Equal(t, expected[i].key, changes[i].key)
+		assert.Equal(t, expected[i].old, changes[i].new)
+		assert.Equal(t, expected[i].new, changes[i].old)
+	}
+
+	Diff(a, a, func(key []byte, old, new Comparable) {
+		assert.Fail(t, "unexpected difference", string(key))
+	})
+
+	Diff(a, a.Clone(), func(key []byte, old, new Comparable) {
+		assert.Fail(t, "unexpected difference", string(key))
+	})
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	r := New()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		r.Insert(key, Bytes(key))
+	}
+
+	s1 := r.Snapshot()
+	defer s1.Release()
+
+	expected := make(map[string]Comparable)
+
+	for i := 0; i < 1000; i += 7 {
+		key := []byte(fmt.Sprintf("key-%d", i))
+
+		switch i % 3 {
+		case 0:
+			r.Delete(key)
+			expected[string(key)] = nil
+		case 1:
+			r.Insert(key, String("changed"))
+			expected[string(key)] = String("changed")
+		default:
+			key = append(key, 'x')
+			r.Insert(key, Bytes(key))
+			expected[string(key)] = Bytes(key)
+		}
+	}
+
+	s2 := r.Snapshot()
+	defer s2.Release()
+
+	// later changes should not be seen by either snapshot
+	r.Insert([]byte("key-1"), String("later"))
+
+	var last []byte
+
+	DiffSnapshots(s1, s2, func(key []byte, old, new Comparable) {
+		assert.True(t, bytes.Compare(last, key) < 0)
+		last = key
+
+		value, ok := expected[string(key)]
+		require.True(t, ok, string(key))
+		assert.Equal(t, value, new)
+		assert.Equal(t, s1.Lookup(key), old)
+
+		delete(expected, string(key))
+	})
+
+	assert.Empty(t, expected)
+}
+
+func TestDiffSnapshotsUnchangedEdges(t *testing.T) {
+	r := New()
+
+	for _, key := range []string{"abc1", "abc2", "abd", "b"} {
+		r.Insert([]byte(key), String(key))
+	}
+
+	s1 := r.Snapshot()
+	defer s1.Release()
+
+	// only the edges of the node for abc change, so
+	// the nodes above it have the same edges in both
+	r.Insert([]byte("abc3"), String("abc3"))
+	r.Insert([]byte("abc1"), String("changed"))
+
+	s2 := r.Snapshot()
+	defer s2.Release()
+
+	var keys []string
+
+	DiffSnapshots(s1, s2, func(key []byte, old, new Comparable) {
+		keys = append(keys, string(key))
+	})
+
+	assert.Equal(t, []string{"abc1", "abc3"}, keys)
+
+	s3 := r.Snapshot()
+	defer s3.Release()
+
+	DiffSnapshots(s2, s3, func(key []byte, old, new Comparable) {
+		t.Errorf("unexpected difference for %s", key)
+	})
+}
+
+// compared is a value that counts how many times it's compared to another value
+type compared struct {
+	count *int
+}
+
+func (c compared) EqualTo(v interface{}) bool {
+	*c.count++
+	return c == v
+}
+
+func TestDiffSnapshotsSkipsUnchanged(t *testing.T) {
+	var comparisons int
+
+	r := New()
+
+	value := compared{count: &comparisons}
+
+	for i := 0; i < 10000; i++ {
+		r.Insert([]byte(fmt.Sprintf("key-%d", i)), value)
+	}
+
+	s1 := r.Snapshot()
+	defer s1.Release()
+
+	r.Insert([]byte("key-1234"), String("changed"))
+	r.Delete([]byte("key-5678"))
+	r.Insert([]byte("key-9999x"), value)
+
+	s2 := r.Snapshot()
+	defer s2.Release()
+
+	// later changes aren't in either snapshot
+	r.Insert([]byte("key-2345"), String("later"))
+
+	var keys []string
+
+	DiffSnapshots(s1, s2, func(key []byte, old, new Comparable) {
+		keys = append(keys, string(key))
+	})
+
+	assert.Equal(t, []string{"key-1234", "key-5678", "key-9999x"}, keys)
+
+	// only the keys near the changes are compared
+	assert.Less(t, comparisons, 100)
+
+	// nothing is compared between snapshots of the same version of the tree
+	s3 := r.Snapshot()
+	defer s3.Release()
+
+	s4 := r.Snapshot()
+	defer s4.Release()
+
+	comparisons = 0
+
+	DiffSnapshots(s3, s4, func(key []byte, old, new Comparable) {
+		t.Errorf("unexpected difference for %s", key)
+	})
+
+	assert.Zero(t, comparisons)
+}
+
+func TestHash(t *testing.T) {
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"}
+
+	a := New()
+	b := New()
+
+	for i := range keys {
+		a.Insert([]byte(keys[i]), String(keys[i]))
+		b.Insert([]byte(keys[len(keys)-i-1]), String(keys[len(keys)-i-1]))
+	}
+
+	// add and remove keys from one tree, so its nodes are split differently
+	b.Insert([]byte("te"), String("te"))
+	b.Insert([]byte("todosx"), String("todosx"))
+	b.Delete([]byte("te"))
+	b.Delete([]byte("todosx"))
+
+	ha, err := a.RootHash()
+	require.Nil(t, err)
+	assert.Len(t, ha, 32)
+
+	hb, err := b.RootHash()
+	require.Nil(t, err)
+	assert.Equal(t, ha, hb)
+
+	empty, err := New().RootHash()
+	require.Nil(t, err)
+	assert.NotEqual(t, ha, empty)
+
+	s := a.Snapshot()
+	defer s.Release()
+
+	// changing a value should change the hash of every subtree containing it
+	sa, err := a.SubtreeHash([]byte("to"))
+	require.Nil(t, err)
+
+	a.Insert([]byte("tomato"), String("changed"))
+
+	h, err := a.RootHash()
+	require.Nil(t, err)
+	assert.NotEqual(t, ha, h)
+
+	h, err = a.SubtreeHash([]byte("to"))
+	require.Nil(t, err)
+	assert.NotEqual(t, sa, h)
+
+	h, err = a.SubtreeHash([]byte("te"))
+	require.Nil(t, err)
+	hb, err = b.SubtreeHash([]byte("te"))
+	require.Nil(t, err)
+	assert.Equal(t, hb, h)
+
+	// the snapshot is unaffected by the change
+	h, err = s.RootHash()
+	require.Nil(t, err)
+	assert.Equal(t, ha, h)
+
+	h, err = s.SubtreeHash([]byte("to"))
+	require.Nil(t, err)
+	assert.Equal(t, sa, h)
+
+	// changing it back should restore the original hash
+	a.Insert([]byte("tomato"), String("tomato"))
+
+	h, err = a.RootHash()
+	require.Nil(t, err)
+	assert.Equal(t, ha, h)
+
+	// prefixes that end part way through a node or have no keys
+	h, err = a.SubtreeHash([]byte("tes"))
+	require.Nil(t, err)
+	hb, err = b.SubtreeHash([]byte("tes"))
+	require.Nil(t, err)
+	assert.Equal(t, hb, h)
+
+	h, err = a.SubtreeHash([]byte("zebra"))
+	require.Nil(t, err)
+	assert.Equal(t, empty, h)
+
+	a.Insert([]byte("counter"), counter(1))
+
+	_, err = a.RootHash()
+	assert.Equal(t, ErrNotHashable, err)
+}
+
+func TestConcurrentHash(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 8
+
+	r := New()
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < 5000; x++ {
+				key := []byte(fmt.Sprintf("%d-%d", b, x%500))
+
+				switch x % 3 {
+				case 0:
+					r.Delete(key)
+				case 1:
+					r.Insert(key, Bytes(key))
+				default:
+					r.Insert(key, String(fmt.Sprint(x)))
+				}
+
+				if x%100 == 0 {
+					_, err := r.RootHash()
+					require.Nil(t, err)
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// the cached hashes should match the hash of a tree built from scratch
+	c := New()
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		c.Insert(key, value)
+	})
+
+	expected, err := c.RootHash()
+	require.Nil(t, err)
+
+	actual, err := r.RootHash()
+	require.Nil(t, err)
+
+	assert.Equal(t, expected, actual)
+}
+
+func TestSetOperations(t *testing.T) {
+	a := New()
+	b := New()
+
+	for _, k := range []string{"test", "test1000", "test1234", "tomato", "todo", "abalienate"} {
+		a.Insert([]byte(k), String("a"))
+	}
+
+	for _, k := range []string{"te", "test", "test12", "test1234", "todos", "tamale", "abalienate"} {
+		b.Insert([]byte(k), String("b"))
+	}
+
+	collect := func(r *ART) map[string]Comparable {
+		values := make(map[string]Comparable)
+
+		r.Iterate(nil, func(key []byte, value Comparable) {
+			values[string(key)] = value
+		})
+
+		assert.Equal(t, len(values), r.Len())
+		assertSizes(t, r)
+
+		return values
+	}
+
+	concat := func(key []byte, a, b Comparable) Comparable {
+		return a.(String) + b.(String)
+	}
+
+	cases := []struct {
+		name     string
+		result   *ART
+		expected map[string]Comparable
+	}{
+		{
+			name:   "union",
+			result: Union(a, b, concat),
+			expected: map[string]Comparable{
+				"abalienate": String("ab"),
+				"tamale":     String("b"),
+				"te":         String("b"),
+				"test":       String("ab"),
+				"test12":     String("b"),
+				"test1000":   String("a"),
+				"test1234":   String("ab"),
+				"todo":       String("a"),
+				"todos":      String("b"),
+				"tomato":     String("a"),
+			},
+		},
+		{
+			name:   "intersect",
+			result: Intersect(a, b, concat),
+			expected: map[string]Comparable{
+				"abalienate": String("ab"),
+				"test":       String("ab"),
+				"test1234":   String("ab"),
+			},
+		},
+		{
+			name:   "intersect-default",
+			result: Intersect(a, b, nil),
+			expected: map[string]Comparable{
+				"abalienate": String("b"),
+				"test":       String("b"),
+				"test1234":   String("b"),
+			},
+		},
+		{
+			name: "intersect-omit",
+			result: Intersect(a, b, func(key []byte, a, b Comparable) Comparable {
+				if string(key) == "test" {
+					return nil
+				}
+				return a
+			}),
+			expected: map[string]Comparable{
+				"abalienate": String("a"),
+				"test1234":   String("a"),
+			},
+		},
+		{
+			name:   "subtract",
+			result: Subtract(a, b),
+			expected: map[string]Comparable{
+				"test1000": String("a"),
+				"todo":     String("a"),
+				"tomato":   String("a"),
+			},
+		},
+		{
+			name:     "subtract-self",
+			result:   Subtract(a, a),
+			expected: map[string]Comparable{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, collect(tc.result))
+		})
+	}
+
+	// the original trees should be unchanged
+	assert.Equal(t, 6, a.Len())
+	assert.Equal(t, 7, b.Len())
+}
+
+func TestSetOperationsRandom(t *testing.T) {
+	a := New()
+	b := New()
+
+	in := make(map[string]int)
+
+	for i := 0; i < 10000; i++ {
+		key := []byte(uuid.New().String()[:4])
+
+		if i%2 == 0 {
+			a.Insert(key, Bytes(key))
+			in[string(key)] |= 1
+		} else {
+			b.Insert(key, Bytes(key))
+			in[string(key)] |= 2
+		}
+	}
+
+	var union, intersect, subtract int
+
+	for _, v := range in {
+		union++
+
+		switch v {
+		case 1:
+			subtract++
+		case 3:
+			intersect++
+		}
+	}
+
+	assert.Equal(t, union, Union(a, b, nil).Len())
+	assert.Equal(t, intersect, Intersect(a, b, nil).Len())
+	assert.Equal(t, subtract, Subtract(a, b).Len())
+
+	Intersect(a, b, nil).Iterate(nil, func(key []byte, value Comparable) {
+		assert.Equal(t, 3, in[string(key)])
+	})
+
+	Subtract(a, b).Iterate(nil, func(key []byte, value Comparable) {
+		assert.Equal(t, 1, in[string(key)])
+	})
+}
+
+func TestSplitAt(t *testing.T) {
+	keys := []string{"abalienate", "tamale", "te", "test", "test1000", "test1234", "todo", "todos", "tomato"}
+
+	cases := []struct {
+		name  string
+		key   string
+		split int
+	}{
+		{"existing-key", "test", 3},
+		{"mid-prefix", "tes", 3},
+		{"between-keys", "test1", 4},
+		{"first", "", 0},
+		{"before-first", "a", 0},
+		{"after-last", "zebra", len(keys)},
+		{"last", "tomato", len(keys) - 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := New()
+
+			for _, k := range keys {
+				r.Insert([]byte(k), String(k))
+			}
+
+			lower, upper := r.SplitAt([]byte(tc.key))
+			assert.Equal(t, r, lower)
+
+			var lk, uk []string
+
+			lower.Iterate(nil, func(key []byte, value Comparable) {
+				assert.Equal(t, String(key), value)
+				lk = append(lk, string(key))
+			})
+
+			upper.Iterate(nil, func(key []byte, value Comparable) {
+				assert.Equal(t, String(key), value)
+				uk = append(uk, string(key))
+			})
+
+			assert.Equal(t, keys[:tc.split], append([]string{}, lk...))
+			assert.Equal(t, keys[tc.split:], append([]string{}, uk...))
+			assert.Equal(t, tc.split, lower.Len())
+			assert.Equal(t, len(keys)-tc.split, upper.Len())
+			assertSizes(t, lower)
+			assertSizes(t, upper)
+
+			// the new tree should be independent of the original
+			upper.Insert([]byte("zebra"), String("zebra"))
+			assert.Nil(t, lower.Lookup([]byte("zebra")))
+
+			require.Nil(t, lower.Join(upper))
+			assert.Equal(t, len(keys)+1, lower.Len())
+			assertSizes(t, lower)
+
+			for _, k := range append(keys, "zebra") {
+				assert.Equal(t, String(k), lower.Lookup([]byte(k)))
+			}
+		})
+	}
+}
+
+func TestSplitAtMovesSubtrees(t *testing.T) {
+	r := New()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		r.Insert(key, Bytes(key))
+	}
+
+	_, moved, _, _ := r.find([]byte("key-9"))
+
+	s := r.Snapshot()
+	defer s.Release()
+
+	lower, upper := r.SplitAt([]byte("key-5"))
+
+	assert.Equal(t, 500, lower.Len())
+	assert.Equal(t, 500, upper.Len())
+	assertSizes(t, lower)
+	assertSizes(t, upper)
+
+	// the subtree is moved into the new tree, rather than being copied
+	_, current, _, _ := upper.find([]byte("key-9"))
+	assert.Equal(t, moved.edges, current.edges)
+
+	// changes to the new tree don't affect the snapshot of the original
+	upper.Insert([]byte("key-999"), String("changed"))
+	upper.Delete([]byte("key-998"))
+
+	assert.Equal(t, Bytes("key-999"), s.Lookup([]byte("key-999")))
+	assert.Equal(t, Bytes("key-998"), s.Lookup([]byte("key-998")))
+	assert.Nil(t, lower.Lookup([]byte("key-999")))
+}
+
+func TestConcurrentSplitAt(t *testing.T) {
+	var wg sync.WaitGroup
+
+	w := 8
+	n := 2000
+
+	r := New()
+
+	// the number of keys each writer has finished inserting
+	inserted := make([]int64, w)
+
+	key := func(b, x int) []byte {
+		return []byte(fmt.Sprintf("%04d-%d", (x*7919)%n, b))
+	}
+
+	wg.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; x < n; x++ {
+				r.Insert(key(b, x), Bytes(key(b, x)))
+				atomic.StoreInt64(&inserted[b], int64(x+1))
+			}
+			wg.Done()
+		}(i)
+	}
+
+	for atomic.LoadInt64(&inserted[0]) < int64(n/4) {
+		runtime.Gosched()
+	}
+
+	before := make([]int64, w)
+	after := make([]int64, w)
+
+	for b := range before {
+		before[b] = atomic.LoadInt64(&inserted[b])
+	}
+
+	lower, upper := r.SplitAt([]byte("1000"))
+
+	for b := range after {
+		after[b] = atomic.LoadInt64(&inserted[b])
+	}
+
+	wg.Wait()
+
+	upper.Iterate(nil, func(key []byte, value Comparable) {
+		require.True(t, string(key) >= "1000", string(key))
+		require.Nil(t, lower.Lookup(key), string(key))
+	})
+
+	for b := 0; b < w; b++ {
+		for x := 0; x < n; x++ {
+			k := key(b, x)
+
+			switch {
+			case string(k) < "1000" || int64(x) > after[b]:
+				// the key is before the split key, or was inserted after the split
+				require.NotNil(t, lower.Lookup(k), string(k))
+			case int64(x) < before[b]:
+				// the key was inserted before the split
+				require.NotNil(t, upper.Lookup(k), string(k))
+			default:
+				require.True(t, lower.Lookup(k) != nil || upper.Lookup(k) != nil, string(k))
+			}
+		}
+	}
+
+	assert.Equal(t, w*n, lower.Len()+upper.Len())
+	assertSizes(t, lower)
+	assertSizes(t, upper)
+}
+
+func TestJoin(t *testing.T) {
+	a := New()
+	b := New()
+
+	keys := make([]string, 10000)
+
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s-%d", uuid.New().String()[:4], i)
+	}
+
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i < len(keys)/2 {
+			a.Insert([]byte(k), String(k))
+		} else {
+			b.Insert([]byte(k), String(k))
+		}
+	}
+
+	// joining in either order should give the same tree
+	c := New()
+	require.Nil(t, c.Join(b))
+	require.Nil(t, c.Join(a))
+
+	require.Nil(t, a.Join(b))
+
+	for _, r := range []*ART{a, c} {
+		var joined []string
+
+		r.Iterate(nil, func(key []byte, value Comparable) {
+			joined = append(joined, string(key))
+		})
+
+		assert.Equal(t, len(keys), r.Len())
+		assert.Equal(t, len(keys), len(joined))
+		assertSizes(t, r)
+	}
+
+	// the other tree is unchanged
+	assert.Equal(t, len(keys)-len(keys)/2, b.Len())
+
+	assert.Equal(t, ErrOverlap, a.Join(b))
+	assert.Equal(t, ErrOverlap, b.Join(a))
+
+	// the trees can be split and joined back together
+	lower, upper := a.SplitAt([]byte(keys[len(keys)/3]))
+	assert.Equal(t, len(keys)/3, lower.Len())
+	assert.Equal(t, len(keys)-len(keys)/3, upper.Len())
+	require.Nil(t, upper.Join(lower))
+	assert.Equal(t, len(keys), upper.Len())
+	assertSizes(t, upper)
+}
+
+func TestView(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("tenant"), String("outside"))
+	r.Insert([]byte("tenant0/z"), String("outside"))
+	r.Insert([]byte("tenant2/a"), String("outside"))
+
+	v := r.Sub([]byte("tenant1/"))
+
+	keys := []string{"", "test", "test1000", "test1234", "todo", "todos", "tomato"}
+
+	for _, k := range keys {
+		assert.True(t, v.Insert([]byte(k), String(k)))
+	}
+
+	assert.Equal(t, len(keys), v.Len())
+	assert.Equal(t, len(keys)+3, r.Len())
+	assert.Equal(t, String("test"), r.Lookup([]byte("tenant1/test")))
+	assert.Equal(t, String("test"), v.Lookup([]byte("test")))
+	assert.Nil(t, v.Lookup([]byte("tenant1/test")))
+
+	var iterated []string
+
+	v.Iterate(nil, func(key []byte, value Comparable) {
+		assert.Equal(t, String(key), value)
+		iterated = append(iterated, string(key))
+	})
+
+	assert.Equal(t, keys, iterated)
+
+	iterated = nil
+
+	v.RangeReverse([]byte("test1"), nil, func(key []byte, value Comparable) bool {
+		iterated = append(iterated, string(key))
+		return true
+	})
+
+	assert.Equal(t, []string{"tomato", "todos", "todo", "test1234", "test1000"}, iterated)
+
+	iterated = nil
+
+	v.Range([]byte("test1"), []byte("todos"), func(key []byte, value Comparable) bool {
+		iterated = append(iterated, string(key))
+		return true
+	})
+
+	assert.Equal(t, []string{"test1000", "test1234", "todo"}, iterated)
+
+	// lookups should not return keys outside of the view
+	key, _, ok := v.Min()
+	require.True(t, ok)
+	assert.Equal(t, []byte{}, key)
+
+	key, _, ok = v.Max()
+	require.True(t, ok)
+	assert.Equal(t, []byte("tomato"), key)
+
+	_, _, ok = v.Predecessor(nil)
+	assert.False(t, ok)
+
+	_, _, ok = v.Successor([]byte("tomato"))
+	assert.False(t, ok)
+
+	key, _, ok = v.Floor([]byte("tomatoes"))
+	require.True(t, ok)
+	assert.Equal(t, []byte("tomato"), key)
+
+	key, _, ok = v.LongestPrefix([]byte("test12345"))
+	require.True(t, ok)
+	assert.Equal(t, []byte("test1234"), key)
+
+	var prefixes []string
+
+	v.Prefixes([]byte("test1234"), func(key []byte, value Comparable) bool {
+		prefixes = append(prefixes, string(key))
+		return true
+	})
+
+	assert.Equal(t, []string{"", "test", "test1234"}, prefixes)
+
+	assert.Equal(t, 2, v.Rank([]byte("test1"))) // "" and "test"
+	key, _, ok = v.Select(2)
+	require.True(t, ok)
+	assert.Equal(t, []byte("test1000"), key)
+
+	_, _, ok = v.Select(len(keys))
+	assert.False(t, ok)
+
+	// nested views compose their prefixes
+	n := v.Sub([]byte("to"))
+
+	assert.Equal(t, 3, n.Len())
+	assert.Equal(t, String("todo"), n.Lookup([]byte("do")))
+	assert.True(t, n.Swap([]byte("do"), String("todo"), String("done")))
+	assert.Equal(t, String("done"), r.Lookup([]byte("tenant1/todo")))
+	assert.Equal(t, 2, n.DeleteRange([]byte("do"), []byte("m")))
+	assert.Equal(t, 1, n.Len())
+
+	assert.Equal(t, 5, v.DeletePrefix(nil))
+	assert.Equal(t, 0, v.Len())
+	assert.Equal(t, 3, r.Len())
+
+	// a tree is a view of all of its keys
+	var w View = r
+
+	assert.Equal(t, String("outside"), w.Sub([]byte("tenant0")).Lookup([]byte("/z")))
+}
+
+func TestLen(t *testing.T) {
+	r := New()
+
+	assert.Equal(t, 0, r.Len())
+	assert.Equal(t, 0, r.CountPrefix(nil))
+
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate"}
+
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
+	}
+
+	assert.Equal(t, len(keys), r.Len())
+
+	// updating or storing nil values should not change the count
+	r.Insert([]byte("test"), String("updated"))
+	r.Insert([]byte("te"), nil)
+	r.Insert([]byte("tod"), nil)
+
+	assert.Equal(t, len(keys), r.Len())
+
+	cases := []struct {
+		Prefix string
+		Count  int
+	}{
+		{"", 8},
+		{"t", 7},
+		{"te", 3},
+		{"tes", 3},
+		{"test", 3},
+		{"test1", 2},
+		{"to", 3},
+		{"tod", 2},
+		{"todos", 1},
+		{"todoss", 0},
+		{"x", 0},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.Count, r.CountPrefix([]byte(tc.Prefix)), tc.Prefix)
+	}
+
+	r.Delete([]byte("test"))
+	r.Delete([]byte("todos"))
+	r.Delete([]byte("missing"))
+
+	assert.Equal(t, len(keys)-2, r.Len())
+	assert.Equal(t, 2, r.CountPrefix([]byte("test")))
+	assert.Equal(t, 1, r.CountPrefix([]byte("tod")))
+	assert.Equal(t, 5, r.CountPrefix([]byte("t")))
+	assertSizes(t, r)
+}
+
+func TestConcurrentLen(t *testing.T) {
+	var writers, readers sync.WaitGroup
+	var done int32
+
+	w := 8
+	n := 3000
+
+	r := New()
+
+	// readers count the keys while they're being changed, so the
+	// sizes of the nodes are counted and kept part way through
+	readers.Add(2)
+
+	for i := 0; i < 2; i++ {
+		go func(b int) {
+			for x := b; atomic.LoadInt32(&done) == 0; x++ {
+				key := []byte(strconv.Itoa(x % n))
+
+				r.CountPrefix(key[:1+x%len(key)])
+				r.Rank(key)
+
+				runtime.Gosched()
+			}
+			readers.Done()
+		}(i)
+	}
+
+	// each writer adds its own keys, some of which are prefixes of
+	// other writers' keys. it then removes every third key and updates
+	// the rest, which replaces the nodes holding them with copies
+	writers.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := b; x < n; x = x + w {
+				key := []byte(strconv.Itoa(x))
+				r.Insert(key, Bytes(key))
+				runtime.Gosched()
+			}
+
+			for x := b; x < n; x = x + w {
+				key := []byte(strconv.Itoa(x))
+
+				if x%3 == 0 {
+					r.Delete(key)
+				} else {
+					r.Insert(key, String(key))
+				}
+
+				runtime.Gosched()
+			}
+
+			writers.Done()
+		}(i)
+	}
+
+	writers.Wait()
+	atomic.StoreInt32(&done, 1)
+	readers.Wait()
+
+	var count int
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		count++
+	})
+
+	assert.Equal(t, 2000, count)
+	assert.Equal(t, count, r.Len())
+	assert.Equal(t, count, r.CountPrefix(nil))
+	assert.Equal(t, 742, r.CountPrefix([]byte("1")))
+	assertSizes(t, r)
+}
+
+func TestLenReplacedNode(t *testing.T) {
+	r := New()
+
+	r.Insert([]byte("a"), String("a"))
+	r.Insert([]byte("ab"), String("ab"))
+	r.Insert([]byte("ac"), String("ac"))
+
+	// count the node for "a" before it's replaced
+	assert.Equal(t, 3, r.CountPrefix([]byte("a")))
+
+	// find the node, then change the keys under it before it's replaced
+	// by a copy, as happens when another writer gets there first
+	parent, current, pos, dv := r.find([]byte("a"))
+
+	r.Insert([]byte("ad"), String("ad"))
+
+	w := r.clock.begin()
+	require.True(t, r.store([]byte("a"), String("updated"), parent, current, pos, dv, &w))
+	r.clock.end(&w)
+
+	assert.Equal(t, 4, r.CountPrefix([]byte("a")))
+	assertSizes(t, r)
+
+	parent, current, pos, dv = r.find([]byte("a"))
+
+	r.Delete([]byte("ab"))
+
+	w = r.clock.begin()
+	require.True(t, r.deleteNode([]byte("a"), parent, current, pos, dv, &w))
+	r.clock.end(&w)
+
+	assert.Equal(t, 2, r.Len())
+	assert.Equal(t, 2, r.CountPrefix([]byte("a")))
+	assertSizes(t, r)
+}
+
+func TestRankSelect(t *testing.T) {
+	r := New()
+
+	_, _, ok := r.Select(0)
+	assert.False(t, ok)
+	assert.Equal(t, 0, r.Rank([]byte("test")))
+
+	keys := []string{"test", "test1000", "test1234", "tomato", "todo", "todos", "tamale", "abalienate", "z"}
+
+	for _, k := range keys {
+		r.Insert([]byte(k), String(k))
+	}
+
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		key, value, ok := r.Select(i)
+		require.True(t, ok)
+		assert.Equal(t, k, string(key))
+		assert.Equal(t, String(k), value)
+		assert.Equal(t, i, r.Rank([]byte(k)))
+	}
+
+	_, _, ok = r.Select(len(keys))
+	assert.False(t, ok)
+
+	_, _, ok = r.Select(-1)
+	assert.False(t, ok)
+
+	cases := []struct {
+		Key  string
+		Rank int
+	}{
+		{"a", 0},
+		{"abalienatf", 1},
+		{"t", 1},
+		{"tes", 2},
+		{"test0", 3},
+		{"test1", 3},
+		{"test12", 4},
+		{"test2", 5},
+		{"todoa", 6},
+		{"tomatoes", 8},
+		{"u", 8},
+		{"zz", 9},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.Rank, r.Rank([]byte(tc.Key)), tc.Key)
+	}
+}
+
+func TestRankSelectRandom(t *testing.T) {
+	r := New()
+
+	keys := make([]string, 2000)
+
+	for i := range keys {
+		keys[i] = uuid.New().String()[:6]
+		r.Insert([]byte(keys[i]), String(keys[i]))
+	}
+
+	sort.Strings(keys)
+
+	// remove duplicates
+	n := 0
+	for i := range keys {
+		if i == 0 || keys[i] != keys[n-1] {
+			keys[n] = keys[i]
+			n++
+		}
+	}
+
+	keys = keys[:n]
+
+	for i, k := range keys {
+		key, _, ok := r.Select(i)
+		require.True(t, ok)
+		require.Equal(t, k, string(key))
+		require.Equal(t, i, r.Rank([]byte(k)))
+	}
+}
+
+func TestConcurrentRankSelect(t *testing.T) {
+	var writers sync.WaitGroup
+	var done int32
+
+	w := 4
+	n := 100
+
+	r := New()
+
+	keys := make([][]byte, n)
+
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("a%03d", i))
+		r.Insert(keys[i], Bytes(keys[i]))
+	}
+
+	// writers add and remove keys that sort after all of the stable keys, but
+	// share nodes with them. half of them are added under the last stable key
+	writers.Add(w)
+
+	for i := 0; i < w; i++ {
+		go func(b int) {
+			for x := 0; atomic.LoadInt32(&done) == 0; x++ {
+				var key []byte
+
+				if b%2 == 0 {
+					key = []byte(fmt.Sprintf("a099/%d/%d", b, x%50))
+				} else {
+					key = []byte(fmt.Sprintf("a1%d%02d", b, x%50))
+				}
+
+				if x%100 < 50 {
+					r.Insert(key, Bytes(key))
+				} else {
+					r.Delete(key)
+				}
+
+				runtime.Gosched()
+			}
+			writers.Done()
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		for x, k := range keys {
+			rank := r.Rank(k)
+			assert.Equal(t, x, rank)
+
+			key, _, ok := r.Select(rank)
+			require.True(t, ok)
+			assert.Equal(t, string(k), string(key))
+
+			runtime.Gosched()
+		}
+	}
+
+	atomic.StoreInt32(&done, 1)
+	writers.Wait()
+
+	var count int
+
+	r.Iterate(nil, func(key []byte, value Comparable) {
+		count++
+	})
+
+	assert.Equal(t, count, r.Len())
+	assertSizes(t, r)
+}
+
+// assertSizes checks the size of every node below the root matches the number
+// of keys stored under it, and that the length of the tree matches its keys
+func assertSizes(t *testing.T, r *ART) {
+	var size uint64
+
+	for i := 0; i < 256; i++ {
+		next := r.root.next(byte(i))
+		if next == nil {
+			continue
+		}
+
+		size = size + assertNodeSizes(t, next)
+
+		if next.value != nil {
+			size++
+		}
+	}
+
+	assert.Equal(t, size, uint64(r.Len()))
+}
+
+func assertNodeSizes(t *testing.T, n *node) uint64 {
+	var size uint64
+
+	for i := 0; i < 256; i++ {
+		next := n.next(byte(i))
+		if next == nil {
+			continue
+		}
+
+		size = size + assertNodeSizes(t, next)
+
+		if next.value != nil {
+			size++
+		}
+	}
+
+	assert.Equal(t, size, n.getSize())
+
+	return size
 }
 
 func BenchmarkConcurrentInsert(b *testing.B) {
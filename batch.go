@@ -0,0 +1,297 @@
+package art
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+var (
+	// ErrEmptyKey is returned when loading a key with no length
+	ErrEmptyKey = errors.New("keys must not be empty")
+	// ErrUnsorted is returned when loading keys that are not unique and in ascending order
+	ErrUnsorted = errors.New("keys must be unique and in ascending order")
+	// ErrBatchLength is returned when a batch has a different number of keys and values
+	ErrBatchLength = errors.New("batch must have the same number of keys and values")
+)
+
+// loader builds a tree from the bottom up from keys that are in ascending order.
+// the stack holds the nodes on the path to the last key that was added, which
+// are built once the next key shows they won't have any more children added
+type loader struct {
+	stack []*pending
+	// the generation of the tree the nodes are built for
+	gen uint64
+}
+
+// pending is a node that is still being built by a loader
+type pending struct {
+	key   []byte
+	value Comparable
+	edges []byte
+	nodes []*node
+	// a node that has already been built, along with everything below it
+	node *node
+}
+
+// BulkLoad inserts keys from an iterator that returns them in ascending order, until it
+// returns false. The keys are built into nodes of the right size before being added to the
+// tree, with each subtree added in a single swap. Keys that are already in the tree have
+// their values replaced. If the keys are empty or out of order, an error is returned and
+// no keys are added. Keys with a nil value are skipped
+func (t *ART) BulkLoad(iter func() ([]byte, Comparable, bool)) error {
+	l := newLoader(atomic.LoadUint64(&t.gen))
+
+	for {
+		key, value, ok := iter()
+		if !ok {
+			break
+		}
+
+		if len(key) < 1 {
+			return ErrEmptyKey
+		}
+
+		if value == nil {
+			continue
+		}
+
+		if !l.add(key, value) {
+			return ErrUnsorted
+		}
+	}
+
+	t.load(l.finish())
+
+	return nil
+}
+
+// InsertBatch inserts a batch of keys in any order. The batch is sorted so keys
+// can be added a subtree at a time, as they would be by BulkLoad. If a key is in
+// the batch more than once, the last value for it is used. As with BulkLoad, keys
+// with a nil value are skipped, leaving any value they have in the tree unchanged
+func (t *ART) InsertBatch(keys [][]byte, values []Comparable) error {
+	if len(keys) != len(values) {
+		return ErrBatchLength
+	}
+
+	order := make([]int, 0, len(keys))
+
+	for i := range keys {
+		if len(keys[i]) < 1 {
+			return ErrEmptyKey
+		}
+
+		order = append(order, i)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	l := newLoader(atomic.LoadUint64(&t.gen))
+
+	for i, x := range order {
+		// skip over any earlier values of the same key
+		if i+1 < len(order) && bytes.Equal(keys[x], keys[order[i+1]]) {
+			continue
+		}
+
+		if values[x] == nil {
+			continue
+		}
+
+		l.add(keys[x], values[x])
+	}
+
+	t.load(l.finish())
+
+	return nil
+}
+
+// load adds the children of a node built by a loader to the tree's root
+func (t *ART) load(root *pending) {
+	for i, b := range root.edges {
+		t.graft(childKey(nil, b, root.nodes[i]), 0, root.nodes[i])
+	}
+}
+
+// graft adds a node that was built outside of the tree to the tree, along with
+// everything below it. pos is the position of the node's edge in its key. if
+// there's already a node at the same position, each of the node's keys and
+// children are added individually instead
+func (t *ART) graft(key []byte, pos int, n *node) {
+	if t.swapIn(key, pos, n) {
+		return
+	}
+
+	if n.value != nil {
+		t.Insert(key, n.value)
+	}
+
+	e := n.getEdges()
+
+	for i := 0; i < 256; i++ {
+		b, next := e.ceiling(byte(i))
+		if next == nil {
+			break
+		}
+
+		i = int(b)
+
+		t.graft(childKey(key, b, next), len(key), next)
+	}
+}
+
+// swapIn adds a node to the tree in a single swap, returning
+// false if there's already a node at the same position
+func (t *ART) swapIn(key []byte, pos int, n *node) bool {
+	w := t.clock.begin()
+	defer t.clock.end(&w)
+
+	for {
+		parent, current, p, _ := t.own(key[:pos+1], &w)
+
+		if current != nil || p != pos {
+			return false
+		}
+
+		if parent.swapNext(key[pos], nil, n, &w) {
+			atomic.AddInt64(&t.size, int64(n.total()))
+			t.invalidate(key[:pos], &w)
+			return true
+		}
+
+		runtime.Gosched()
+	}
+}
+
+func newLoader(gen uint64) *loader {
+	return &loader{
+		stack: []*pending{{}},
+		gen:   gen,
+	}
+}
+
+// add adds a key to the loader, returning false if it's not after the last key added
+func (l *loader) add(key []byte, value Comparable) bool {
+	return l.push(key, &pending{value: value})
+}
+
+// addNode adds a node that has already been built to the loader, along with everything
+// below it. no more keys can be added under the node, as its edges are already built
+func (l *loader) addNode(key []byte, n *node) bool {
+	return l.push(key, &pending{value: n.value, node: n})
+}
+
+// push adds a pending node for a key, returning false if it's not after the last key added
+func (l *loader) push(key []byte, p *pending) bool {
+	top := l.stack[len(l.stack)-1]
+
+	if bytes.Compare(key, top.key) <= 0 {
+		return false
+	}
+
+	if top.node != nil && bytes.HasPrefix(key, top.key) {
+		return false
+	}
+
+	l.collapse(divergence(top.key, key))
+
+	// the key is copied, as the node prefixes built from it will refer to it
+	p.key = make([]byte, len(key))
+	copy(p.key, key)
+
+	l.stack = append(l.stack, p)
+
+	return true
+}
+
+// collapse builds all of the nodes on the stack with keys longer than depth,
+// adding them as children of the nodes beneath them on the stack
+func (l *loader) collapse(depth int) {
+	for {
+		top := l.stack[len(l.stack)-1]
+
+		if len(top.key) <= depth {
+			return
+		}
+
+		l.stack = l.stack[:len(l.stack)-1]
+
+		parent := l.stack[len(l.stack)-1]
+
+		if len(parent.key) < depth {
+			// the next key diverges from this one below the parent,
+			// so add a node for them to branch from
+			parent = &pending{key: top.key[:depth]}
+			l.stack = append(l.stack, parent)
+		}
+
+		d := len(parent.key)
+
+		parent.edges = append(parent.edges, top.key[d])
+		parent.nodes = append(parent.nodes, top.build(top.key[d+1:], l.gen))
+	}
+}
+
+// finish builds all remaining nodes, returning the root
+func (l *loader) finish() *pending {
+	l.collapse(0)
+	return l.stack[0]
+}
+
+// build creates a node with edges sized for its number of children,
+// belonging to the given generation of a tree. a node that was already
+// built is replaced with one that takes over its edges, unless it's from
+// another generation, as they may be shared with a clone of its tree
+func (p *pending) build(prefix []byte, gen uint64) *node {
+	if p.node != nil {
+		e := p.node.edges
+
+		if atomic.LoadUint64(&p.node.gen) != gen {
+			e = copyEdges(p.node)
+		}
+
+		return &node{
+			prefix: prefix,
+			value:  p.value,
+			edges:  e,
+			gen:    gen,
+		}
+	}
+
+	var ne edges
+	var size uint64
+
+	switch {
+	case len(p.edges) < 1:
+		ne = leaf
+	case len(p.edges) <= 4:
+		ne = newEdges4()
+	case len(p.edges) <= 16:
+		ne = newEdges16()
+	case len(p.edges) <= 48:
+		ne = newEdges48()
+	default:
+		ne = newEdges256()
+	}
+
+	for i, b := range p.edges {
+		ne.setNext(b, p.nodes[i])
+		size = size + p.nodes[i].total()
+	}
+
+	e := unsafe.Pointer(&ne)
+
+	return &node{
+		size:   sizeCounted | size,
+		prefix: prefix,
+		value:  p.value,
+		edges:  &e,
+		gen:    gen,
+	}
+}
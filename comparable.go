@@ -7,6 +7,12 @@ type Comparable interface {
 	EqualTo(v interface{}) bool
 }
 
+// Hashable defines an interface for values that can be hashed by RootHash and SubtreeHash
+type Hashable interface {
+	// Hash returns the bytes that identify the value, such as its encoding
+	Hash() []byte
+}
+
 // Bytes defines a byteslice that satisfies the comparable interface
 type Bytes []byte
 
@@ -20,6 +26,11 @@ func (b Bytes) EqualTo(v interface{}) bool {
 	return bytes.Equal(b, cv)
 }
 
+// Hash returns the bytes of the value
+func (b Bytes) Hash() []byte {
+	return b
+}
+
 // String defines a string that satisfies the comparable interface
 type String string
 
@@ -32,3 +43,17 @@ func (s String) EqualTo(v interface{}) bool {
 
 	return s == cv
 }
+
+// Hash returns the bytes of the value
+func (s String) Hash() []byte {
+	return []byte(s)
+}
+
+// equal returns true if both values are equal or both are nil
+func equal(a, b Comparable) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return a.EqualTo(b)
+}
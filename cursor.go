@@ -0,0 +1,197 @@
+package art
+
+// Cursor allows for stepping through the keys of a tree in either direction
+type Cursor struct {
+	tree  *ART
+	stack []frame
+}
+
+// frame is a node on the cursor's path through the tree
+type frame struct {
+	key   []byte
+	node  *node
+	edges edges
+	// the edge currently being visited. the node at the top of
+	// the stack has an edge of -1 when the cursor is positioned on it
+	edge int
+}
+
+// Cursor creates a new cursor for the tree
+func (t *ART) Cursor() *Cursor {
+	return &Cursor{
+		tree: t,
+	}
+}
+
+// First moves the cursor to the first key in the tree
+func (c *Cursor) First() bool {
+	c.reset(-1)
+	return c.forward()
+}
+
+// Last moves the cursor to the last key in the tree
+func (c *Cursor) Last() bool {
+	c.reset(256)
+	return c.backward()
+}
+
+// Seek moves the cursor to the first key that is equal to or greater than the given key
+func (c *Cursor) Seek(key []byte) bool {
+	c.reset(-1)
+
+	for {
+		top := &c.stack[len(c.stack)-1]
+		d := len(top.key)
+
+		if d == len(key) {
+			if top.node.value != nil {
+				return true
+			}
+
+			return c.forward()
+		}
+
+		b := key[d]
+
+		next := top.edges.next(b)
+		if next == nil {
+			top.edge = int(b)
+			return c.forward()
+		}
+
+		switch compareBound(next.prefix, key[d+1:]) {
+		case -1:
+			// every key under the child is before the key we're looking for
+			top.edge = int(b)
+			return c.forward()
+		case 1:
+			// every key under the child is after the key we're looking for
+			top.edge = int(b) - 1
+			return c.forward()
+		}
+
+		top.edge = int(b)
+		c.push(top.key, b, next, -1)
+	}
+}
+
+// Next moves the cursor to the next key
+func (c *Cursor) Next() bool {
+	if len(c.stack) < 1 {
+		return false
+	}
+
+	return c.forward()
+}
+
+// Prev moves the cursor to the previous key
+func (c *Cursor) Prev() bool {
+	if len(c.stack) < 1 {
+		return false
+	}
+
+	// the node the cursor is positioned on sorts before all of its children,
+	// so move straight back to its parent
+	c.stack = c.stack[:len(c.stack)-1]
+
+	return c.backward()
+}
+
+// Valid returns true if the cursor is positioned on a key
+func (c *Cursor) Valid() bool {
+	return len(c.stack) > 0
+}
+
+// Key returns the key the cursor is positioned on
+func (c *Cursor) Key() []byte {
+	if len(c.stack) < 1 {
+		return nil
+	}
+
+	return c.stack[len(c.stack)-1].key
+}
+
+// Value returns the value of the key the cursor is positioned on
+func (c *Cursor) Value() Comparable {
+	if len(c.stack) < 1 {
+		return nil
+	}
+
+	return c.stack[len(c.stack)-1].node.value
+}
+
+func (c *Cursor) reset(edge int) {
+	c.stack = append(c.stack[:0], frame{
+		node:  c.tree.root,
+		edges: c.tree.getEdges(c.tree.root),
+		edge:  edge,
+	})
+}
+
+func (c *Cursor) push(key []byte, b byte, next *node, edge int) {
+	c.stack = append(c.stack, frame{
+		key:   childKey(key, b, next),
+		node:  next,
+		edges: c.tree.getEdges(next),
+		edge:  edge,
+	})
+}
+
+// forward walks the tree in order from the top of the stack until it finds a key
+func (c *Cursor) forward() bool {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+
+		var b byte
+		var next *node
+
+		if top.edge < 255 {
+			b, next = top.edges.ceiling(byte(top.edge + 1))
+		}
+
+		if next == nil {
+			c.stack = c.stack[:len(c.stack)-1]
+			continue
+		}
+
+		top.edge = int(b)
+		c.push(top.key, b, next, -1)
+
+		if next.value != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backward walks the tree in reverse order from the top of the stack until it finds a key
+func (c *Cursor) backward() bool {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+
+		var b byte
+		var next *node
+
+		if top.edge > 0 {
+			b, next = top.edges.floor(byte(top.edge - 1))
+		}
+
+		if next != nil {
+			top.edge = int(b)
+			c.push(top.key, b, next, 256)
+			continue
+		}
+
+		// all of the node's children have been visited, so its own key is next
+		top.edge = -1
+
+		if top.node.value != nil {
+			return true
+		}
+
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+package art
+
+import "math"
+
+// Diff calls fn in order for every key whose value differs between two trees.
+// old is nil for keys that have been added to b, while new is nil for keys that
+// have been removed from it. Values are compared with their EqualTo method.
+// When comparing two snapshots of the same tree, any node that's in both is
+// skipped if none of the keys under it have changed between the snapshots, so
+// the time taken depends on the number of changes rather than the size of the tree
+func Diff(a, b *ART, fn func(key []byte, old, new Comparable)) {
+	w := walker{
+		a:     a,
+		b:     b,
+		left:  true,
+		right: true,
+		since: since(a, b),
+		fn: func(key []byte, old, new Comparable) {
+			if equal(old, new) {
+				return
+			}
+
+			// copy the key, as it's reused between calls
+			k := make([]byte, len(key))
+			copy(k, key)
+
+			fn(k, old, new)
+		},
+	}
+
+	w.walk()
+}
+
+// since returns the version nodes in both trees must not have changed since to be
+// skipped. every node is the same in two trees reading the same version of a tree,
+// while the latest version of a tree can be changed while it's being compared
+func since(a, b *ART) uint64 {
+	switch {
+	case a.root == b.root && a.version == b.version:
+		return math.MaxUint64
+	case a.clock != b.clock || a.version == 0 || b.version == 0:
+		return 0
+	case a.version < b.version:
+		return a.version
+	default:
+		return b.version
+	}
+}
+
+// DiffSnapshots calls fn in order for every key whose value differs between two snapshots
+func DiffSnapshots(a, b *ReadOnlyART, fn func(key []byte, old, new Comparable)) {
+	Diff(a.tree, b.tree, fn)
+}
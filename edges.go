@@ -4,9 +4,17 @@ type edges interface {
 	ntype() uint8
 	next(b byte) *node
 	setNext(b byte, next *node)
+	remove(b byte)
+	minimum() (byte, *node)
+	maximum() (byte, *node)
+	ceiling(b byte) (byte, *node)
+	floor(b byte) (byte, *node)
+	count() int
 	copy() edges
 	upgrade() edges
+	downgrade() edges
 	full() bool
+	sparse() bool
 }
 
 var leaf = (edges)(&edgesLeaf{})
@@ -24,6 +32,29 @@ func (e *edgesLeaf) next(b byte) *node {
 func (e *edgesLeaf) setNext(b byte, next *node) {
 }
 
+func (e *edgesLeaf) remove(b byte) {
+}
+
+func (e *edgesLeaf) minimum() (byte, *node) {
+	return 0, nil
+}
+
+func (e *edgesLeaf) maximum() (byte, *node) {
+	return 0, nil
+}
+
+func (e *edgesLeaf) ceiling(b byte) (byte, *node) {
+	return 0, nil
+}
+
+func (e *edgesLeaf) floor(b byte) (byte, *node) {
+	return 0, nil
+}
+
+func (e *edgesLeaf) count() int {
+	return 0
+}
+
 func (e *edgesLeaf) copy() edges {
 	return e
 }
@@ -32,6 +63,21 @@ func (e *edgesLeaf) upgrade() edges {
 	return newEdges4()
 }
 
+func (e *edgesLeaf) downgrade() edges {
+	return e
+}
+
 func (e *edgesLeaf) full() bool {
 	return true
 }
+
+func (e *edgesLeaf) sparse() bool {
+	return false
+}
+
+// edgesFrozen wraps the edges of a node that is being unlinked from
+// its parent. reads pass through to the wrapped edges, but any attempt
+// to swap one of its edges will fail until the node is thawed
+type edgesFrozen struct {
+	edges
+}
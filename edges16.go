@@ -30,7 +30,7 @@ func (e *edges16) next(b byte) *node {
 func (e *edges16) setNext(b byte, next *node) {
 	p := e.search(b)
 
-	if e.keys[p] == b {
+	if p < e.children && e.keys[p] == b {
 		e.edges[p] = next
 		return
 	}
@@ -43,8 +43,23 @@ func (e *edges16) setNext(b byte, next *node) {
 	e.children++
 }
 
+func (e *edges16) remove(b byte) {
+	i := e.search(b)
+
+	if i == e.children || e.keys[i] != b {
+		return
+	}
+
+	copy(e.keys[i:], e.keys[i+1:])
+	copy(e.edges[i:], e.edges[i+1:])
+
+	e.children--
+	e.keys[e.children] = 0
+	e.edges[e.children] = nil
+}
+
 func (e *edges16) search(b byte) uint8 {
-	for i := uint8(0); i < uint8(len(e.keys)); i++ {
+	for i := uint8(0); i < e.children; i++ {
 		if e.keys[i] >= b {
 			return i
 		}
@@ -52,6 +67,42 @@ func (e *edges16) search(b byte) uint8 {
 	return e.children
 }
 
+func (e *edges16) minimum() (byte, *node) {
+	return e.keys[0], e.edges[0]
+}
+
+func (e *edges16) maximum() (byte, *node) {
+	if e.children == 0 {
+		return 0, nil
+	}
+
+	return e.keys[e.children-1], e.edges[e.children-1]
+}
+
+func (e *edges16) ceiling(b byte) (byte, *node) {
+	i := e.search(b)
+
+	if i == e.children {
+		return 0, nil
+	}
+
+	return e.keys[i], e.edges[i]
+}
+
+func (e *edges16) floor(b byte) (byte, *node) {
+	for i := int(e.children) - 1; i >= 0; i-- {
+		if e.keys[i] <= b {
+			return e.keys[i], e.edges[i]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges16) count() int {
+	return int(e.children)
+}
+
 func (e *edges16) copy() edges {
 	ne := &edges16{
 		children: e.children,
@@ -71,9 +122,25 @@ func (e *edges16) upgrade() edges {
 		newEdges.edges[i] = e.edges[i]
 	}
 
+	newEdges.children = e.children
+
+	return newEdges
+}
+
+func (e *edges16) downgrade() edges {
+	newEdges := newEdges4()
+
+	copy(newEdges.keys[:], e.keys[:e.children])
+	copy(newEdges.edges[:], e.edges[:e.children])
+	newEdges.children = e.children
+
 	return newEdges
 }
 
 func (e *edges16) full() bool {
 	return e.children == 16
 }
+
+func (e *edges16) sparse() bool {
+	return e.children < 4
+}
@@ -2,7 +2,7 @@ package art
 
 type edges256 struct {
 	edges    [256]*node
-	children uint8
+	children uint16
 }
 
 func newEdges256() *edges256 {
@@ -24,6 +24,51 @@ func (e *edges256) setNext(b byte, next *node) {
 	e.edges[b] = next
 }
 
+func (e *edges256) remove(b byte) {
+	if e.edges[b] != nil {
+		e.edges[b] = nil
+		e.children--
+	}
+}
+
+func (e *edges256) minimum() (byte, *node) {
+	for i := 0; i < 256; i++ {
+		if e.edges[i] != nil {
+			return byte(i), e.edges[i]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges256) maximum() (byte, *node) {
+	return e.floor(255)
+}
+
+func (e *edges256) ceiling(b byte) (byte, *node) {
+	for i := int(b); i < 256; i++ {
+		if e.edges[i] != nil {
+			return byte(i), e.edges[i]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges256) floor(b byte) (byte, *node) {
+	for i := int(b); i >= 0; i-- {
+		if e.edges[i] != nil {
+			return byte(i), e.edges[i]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges256) count() int {
+	return int(e.children)
+}
+
 func (e *edges256) copy() edges {
 	ne := &edges256{
 		children: e.children,
@@ -38,6 +83,22 @@ func (e *edges256) upgrade() edges {
 	return e
 }
 
+func (e *edges256) downgrade() edges {
+	newEdges := newEdges48()
+
+	for i := 0; i < 256; i++ {
+		if e.edges[i] != nil {
+			newEdges.setNext(byte(i), e.edges[i])
+		}
+	}
+
+	return newEdges
+}
+
 func (e *edges256) full() bool {
 	return false
 }
+
+func (e *edges256) sparse() bool {
+	return e.children < 38
+}
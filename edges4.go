@@ -34,7 +34,7 @@ func (e *edges4) next(b byte) *node {
 func (e *edges4) setNext(b byte, next *node) {
 	i := e.search(b)
 
-	if e.keys[i] == b {
+	if i < e.children && e.keys[i] == b {
 		e.edges[i] = next
 		return
 	}
@@ -47,8 +47,23 @@ func (e *edges4) setNext(b byte, next *node) {
 	e.children++
 }
 
+func (e *edges4) remove(b byte) {
+	i := e.search(b)
+
+	if i == e.children || e.keys[i] != b {
+		return
+	}
+
+	copy(e.keys[i:], e.keys[i+1:])
+	copy(e.edges[i:], e.edges[i+1:])
+
+	e.children--
+	e.keys[e.children] = 0
+	e.edges[e.children] = nil
+}
+
 func (e *edges4) search(b byte) uint8 {
-	for i := uint8(0); i < uint8(len(e.keys)); i++ {
+	for i := uint8(0); i < e.children; i++ {
 		if e.keys[i] >= b {
 			return i
 		}
@@ -56,6 +71,42 @@ func (e *edges4) search(b byte) uint8 {
 	return e.children
 }
 
+func (e *edges4) minimum() (byte, *node) {
+	return e.keys[0], e.edges[0]
+}
+
+func (e *edges4) maximum() (byte, *node) {
+	if e.children == 0 {
+		return 0, nil
+	}
+
+	return e.keys[e.children-1], e.edges[e.children-1]
+}
+
+func (e *edges4) ceiling(b byte) (byte, *node) {
+	i := e.search(b)
+
+	if i == e.children {
+		return 0, nil
+	}
+
+	return e.keys[i], e.edges[i]
+}
+
+func (e *edges4) floor(b byte) (byte, *node) {
+	for i := int(e.children) - 1; i >= 0; i-- {
+		if e.keys[i] <= b {
+			return e.keys[i], e.edges[i]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges4) count() int {
+	return int(e.children)
+}
+
 func (e *edges4) copy() edges {
 	ne := &edges4{
 		children: e.children,
@@ -77,6 +128,14 @@ func (e *edges4) upgrade() edges {
 	return newEdges
 }
 
+func (e *edges4) downgrade() edges {
+	return leaf
+}
+
 func (e *edges4) full() bool {
 	return e.children == 4
 }
+
+func (e *edges4) sparse() bool {
+	return e.children == 0
+}
@@ -35,6 +35,70 @@ func (e *edges48) setNext(b byte, next *node) {
 	e.children++
 }
 
+func (e *edges48) remove(b byte) {
+	i := e.keys[b]
+
+	if i == 0 {
+		return
+	}
+
+	// move the last edge into the freed slot so the edges stay packed
+	last := e.children
+
+	if i != last {
+		for k := 0; k < 256; k++ {
+			if e.keys[k] == last {
+				e.keys[k] = i
+				break
+			}
+		}
+
+		e.edges[i-1] = e.edges[last-1]
+	}
+
+	e.keys[b] = 0
+	e.edges[last-1] = nil
+	e.children--
+}
+
+func (e *edges48) minimum() (byte, *node) {
+	for i := 0; i < 256; i++ {
+		if e.keys[i] > 0 {
+			return byte(i), e.edges[e.keys[i]-1]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges48) maximum() (byte, *node) {
+	return e.floor(255)
+}
+
+func (e *edges48) ceiling(b byte) (byte, *node) {
+	for i := int(b); i < 256; i++ {
+		if e.keys[i] > 0 {
+			return byte(i), e.edges[e.keys[i]-1]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges48) floor(b byte) (byte, *node) {
+	for i := int(b); i >= 0; i-- {
+		if e.keys[i] > 0 {
+			return byte(i), e.edges[e.keys[i]-1]
+		}
+	}
+
+	return 0, nil
+}
+
+func (e *edges48) count() int {
+	return int(e.children)
+}
+
 func (e *edges48) copy() edges {
 	ne := &edges48{
 		children: e.children,
@@ -55,9 +119,29 @@ func (e *edges48) upgrade() edges {
 		}
 	}
 
+	newEdges.children = uint16(e.children)
+
+	return newEdges
+}
+
+func (e *edges48) downgrade() edges {
+	newEdges := newEdges16()
+
+	for i := 0; i < 256; i++ {
+		if e.keys[i] > 0 {
+			newEdges.keys[newEdges.children] = byte(i)
+			newEdges.edges[newEdges.children] = e.edges[e.keys[i]-1]
+			newEdges.children++
+		}
+	}
+
 	return newEdges
 }
 
 func (e *edges48) full() bool {
 	return e.children == 48
 }
+
+func (e *edges48) sparse() bool {
+	return e.children < 13
+}
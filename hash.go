@@ -0,0 +1,186 @@
+package art
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// the first byte of each hash, so hashes of
+	// different kinds of data can't be confused
+	hashEmpty byte = iota
+	hashNode
+	hashEdge
+)
+
+// ErrNotHashable is returned when hashing a tree with values that don't implement Hashable
+var ErrNotHashable = errors.New("values must implement Hashable to be hashed")
+
+// digest is the hash of the keys and values under a node. keys are hashed by the
+// bytes where they branch off from each other, rather than by the node prefixes that
+// store them, so trees with the same keys and values have the same hashes, regardless
+// of the order the keys were added in
+type digest struct {
+	// the version of the node's size when it was hashed. the
+	// digest is only valid while the version is unchanged
+	version uint64
+	// the bytes after the node's key that are shared by all of the keys under it,
+	// if the node has no value and a single child
+	extension []byte
+	// the hash of the keys and values under the extension, or nil if there are none
+	sum []byte
+}
+
+// RootHash returns a hash of all of the keys and values in the tree. Trees with the same
+// keys and values have the same hash. Hashes of nodes are cached until a key under them
+// changes, so hashing a tree again after a few changes only hashes the nodes on the path
+// to the keys that changed. If the tree is changed while it's being hashed, the hash may
+// include some of the changes
+func (t *ART) RootHash() ([]byte, error) {
+	return t.SubtreeHash(nil)
+}
+
+// SubtreeHash returns a hash of all of the keys with the given prefix and their values.
+// Comparing the hashes of subtrees with the same prefix in two trees shows whether the
+// keys under them are the same, so the keys that differ can be found without comparing
+// every key in the trees
+func (t *ART) SubtreeHash(prefix []byte) ([]byte, error) {
+	if t.version == 0 && !t.hashed() {
+		atomic.StoreInt32(&t.hashing, 1)
+	}
+
+	key, current := t.findPrefix(prefix)
+	if current == nil {
+		return edgeSum(nil, nil, nil), nil
+	}
+
+	d, err := t.digest(current)
+	if err != nil {
+		return nil, err
+	}
+
+	return edgeSum(key[len(prefix):], d.extension, d.sum), nil
+}
+
+// hashed returns true if the tree has been hashed
+func (t *ART) hashed() bool {
+	return atomic.LoadInt32(&t.hashing) == 1
+}
+
+// digest returns the digest of a node, using the digest cached on the
+// node if nothing under it has changed since it was calculated. digests
+// are only cached when reading the latest version of the tree
+func (t *ART) digest(n *node) (*digest, error) {
+	cache := t.version == 0
+
+	// load the version before the edges, so if a key under the node changes
+	// after we've hashed it, the node's version will no longer match our digest
+	v := n.version()
+
+	if cache {
+		d := (*digest)(atomic.LoadPointer(&n.hash))
+		if d != nil && d.version == v {
+			return d, nil
+		}
+	}
+
+	var edges []byte
+	var nodes []*node
+	var digests []*digest
+
+	e := t.getEdges(n)
+
+	for i := 0; i < 256; i++ {
+		b, next := e.ceiling(byte(i))
+		if next == nil {
+			break
+		}
+
+		i = int(b)
+
+		d, err := t.digest(next)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.sum == nil {
+			// there are no keys under the child
+			continue
+		}
+
+		edges = append(edges, b)
+		nodes = append(nodes, next)
+		digests = append(digests, d)
+	}
+
+	d := &digest{version: v}
+
+	switch {
+	case n.value == nil && len(edges) < 1:
+	case n.value == nil && len(edges) == 1:
+		// the node doesn't branch, so its keys are hashed as part of its child's
+		d.extension = make([]byte, 0, 1+len(nodes[0].prefix)+len(digests[0].extension))
+		d.extension = append(d.extension, edges[0])
+		d.extension = append(d.extension, nodes[0].prefix...)
+		d.extension = append(d.extension, digests[0].extension...)
+		d.sum = digests[0].sum
+	default:
+		h := sha256.New()
+		h.Write([]byte{hashNode})
+
+		if n.value == nil {
+			h.Write([]byte{0})
+		} else {
+			v, ok := n.value.(Hashable)
+			if !ok {
+				return nil, ErrNotHashable
+			}
+
+			value := v.Hash()
+
+			h.Write([]byte{1})
+			h.Write(uvarint(len(value)))
+			h.Write(value)
+		}
+
+		for i := range edges {
+			h.Write([]byte{edges[i]})
+			h.Write(edgeSum(nodes[i].prefix, digests[i].extension, digests[i].sum))
+		}
+
+		d.sum = h.Sum(nil)
+	}
+
+	if cache {
+		atomic.StorePointer(&n.hash, unsafe.Pointer(d))
+	}
+
+	return d, nil
+}
+
+// edgeSum hashes the keys under an edge, from the bytes that are
+// shared by all of the keys and the hash of the keys below them
+func edgeSum(prefix, extension, sum []byte) []byte {
+	h := sha256.New()
+
+	if sum == nil {
+		h.Write([]byte{hashEmpty})
+		return h.Sum(nil)
+	}
+
+	h.Write([]byte{hashEdge})
+	h.Write(uvarint(len(prefix) + len(extension)))
+	h.Write(prefix)
+	h.Write(extension)
+	h.Write(sum)
+
+	return h.Sum(nil)
+}
+
+func uvarint(x int) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, uint64(x))]
+}
@@ -1,25 +1,70 @@
 package art
 
-// Iterate over every key from a given point
+import "bytes"
+
+// Iterate over every key that starts with a given prefix
 func (t *ART) Iterate(from []byte, fn func(key []byte, value Comparable)) {
-	var current *node
+	t.Walk(from, func(key []byte, value Comparable) error {
+		fn(key, value)
+		return nil
+	})
+}
+
+// Walk iterates over every key that starts with a given prefix. If fn returns
+// an error, iteration will stop and the error will be returned
+func (t *ART) Walk(from []byte, fn func(key []byte, value Comparable) error) error {
+	key, current := t.findPrefix(from)
+	if current == nil {
+		return nil
+	}
+
+	if current.value != nil {
+		err := fn(key, current.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.iterate(key, current, fn)
+}
+
+// findPrefix returns the highest node whose key starts with
+// the given prefix, along with the node's full key
+func (t *ART) findPrefix(prefix []byte) ([]byte, *node) {
+	if len(prefix) < 1 {
+		return nil, t.root
+	}
+
+	parent, current, pos, dv := t.find(prefix)
 
-	if len(from) > 0 {
-		_, current, _, _ = t.find(from)
-	} else {
-		current = t.root
+	switch {
+	case current == nil:
+		// there is no edge for the next character of the prefix
+		return nil, nil
+	case shouldUpdate(prefix, current, parent, pos, dv):
+		return prefix, current
+	case pos+dv == len(prefix):
+		// the prefix ends part way through the node's prefix,
+		// so the node's key is longer than the prefix
+		key := make([]byte, pos, pos+len(current.prefix))
+		copy(key, prefix)
+
+		return append(key, current.prefix...), current
 	}
 
-	t.iterate(from, current, fn)
+	// the prefix diverges from the node's prefix
+	return nil, nil
 }
 
-func (t *ART) iterate(key []byte, current *node, fn func(key []byte, value Comparable)) {
+func (t *ART) iterate(key []byte, current *node, fn func(key []byte, value Comparable) error) error {
 	if current.edges == nil {
-		return
+		return nil
 	}
 
+	e := t.getEdges(current)
+
 	for i := 0; i < 256; i++ {
-		next := current.next(byte(i))
+		next := e.next(byte(i))
 		if next == nil {
 			continue
 		}
@@ -34,9 +79,217 @@ func (t *ART) iterate(key []byte, current *node, fn func(key []byte, value Compa
 		}
 
 		if next.value != nil {
-			fn(ckey, next.value)
+			err := fn(ckey, next.value)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := t.iterate(ckey, next, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IterateReverse iterates over every key with a given prefix in descending order
+func (t *ART) IterateReverse(prefix []byte, fn func(key []byte, value Comparable)) {
+	t.RangeReverse(prefix, prefixEnd(prefix), func(key []byte, value Comparable) bool {
+		fn(key, value)
+		return true
+	})
+}
+
+// Range iterates over every key in order from start up to, but not including end.
+// If end is empty, all keys from start onwards will be visited. Iteration will
+// stop if fn returns false
+func (t *ART) Range(start, end []byte, fn func(key []byte, value Comparable) bool) {
+	t.rangeIterate(nil, t.root, start, end, true, len(end) > 0, fn)
+}
+
+// RangeReverse iterates over every key in descending order from the last key before
+// end down to start. If end is empty, iteration will start from the last key in the
+// tree. Iteration will stop if fn returns false
+func (t *ART) RangeReverse(start, end []byte, fn func(key []byte, value Comparable) bool) {
+	t.rangeIterateReverse(nil, t.root, start, end, true, len(end) > 0, fn)
+}
+
+// rangeIterate visits the keys of a node's subtree that are inside the range.
+// lower and upper are true while the node's key is still a prefix of start and
+// end respectively. returns false if iteration has been stopped
+func (t *ART) rangeIterate(key []byte, current *node, start, end []byte, lower, upper bool, fn func(key []byte, value Comparable) bool) bool {
+	d := len(key)
+
+	if lower && len(start) == d {
+		// the node's key is the start key, so all keys below it are in range
+		lower = false
+	}
+
+	if upper && len(end) == d {
+		// the node's key is the end key, so it and all keys below it are out of range
+		return true
+	}
+
+	if !lower && current.value != nil {
+		if !fn(key, current.value) {
+			return false
+		}
+	}
+
+	lo, hi := rangeEdges(d, start, end, lower, upper)
+
+	e := t.getEdges(current)
+
+	for i := lo; i <= hi; i++ {
+		b, next := e.ceiling(byte(i))
+		if next == nil || int(b) > hi {
+			break
+		}
+
+		i = int(b)
+
+		nl, nu, ok := rangeBounds(next, d, start, end, lower && i == lo, upper && i == hi)
+		if !ok {
+			continue
+		}
+
+		if !t.rangeIterate(childKey(key, b, next), next, start, end, nl, nu, fn) {
+			return false
 		}
+	}
+
+	return true
+}
+
+// rangeIterateReverse visits the keys of a node's subtree that are inside
+// the range in descending order, the reverse of rangeIterate
+func (t *ART) rangeIterateReverse(key []byte, current *node, start, end []byte, lower, upper bool, fn func(key []byte, value Comparable) bool) bool {
+	d := len(key)
 
-		t.iterate(ckey, next, fn)
+	if lower && len(start) == d {
+		lower = false
 	}
+
+	if upper && len(end) == d {
+		return true
+	}
+
+	lo, hi := rangeEdges(d, start, end, lower, upper)
+
+	e := t.getEdges(current)
+
+	for i := hi; i >= lo; i-- {
+		b, next := e.floor(byte(i))
+		if next == nil || int(b) < lo {
+			break
+		}
+
+		i = int(b)
+
+		nl, nu, ok := rangeBounds(next, d, start, end, lower && i == lo, upper && i == hi)
+		if !ok {
+			continue
+		}
+
+		if !t.rangeIterateReverse(childKey(key, b, next), next, start, end, nl, nu, fn) {
+			return false
+		}
+	}
+
+	// a node's key sorts before all of the keys below it
+	if !lower && current.value != nil {
+		return fn(key, current.value)
+	}
+
+	return true
+}
+
+// rangeEdges returns the range of edges of a node at
+// a given depth that may contain keys inside the range
+func rangeEdges(d int, start, end []byte, lower, upper bool) (int, int) {
+	lo, hi := 0, 255
+
+	if lower {
+		lo = int(start[d])
+	}
+
+	if upper {
+		hi = int(end[d])
+	}
+
+	return lo, hi
+}
+
+// rangeBounds checks the prefix of a child node against the range, returning
+// whether its key is still a prefix of start and end respectively. if none of
+// the keys under the child are in range, ok is false
+func rangeBounds(next *node, d int, start, end []byte, lower, upper bool) (bool, bool, bool) {
+	if lower {
+		switch compareBound(next.prefix, start[d+1:]) {
+		case -1:
+			return false, false, false
+		case 1:
+			lower = false
+		}
+	}
+
+	if upper {
+		switch compareBound(next.prefix, end[d+1:]) {
+		case -1:
+			upper = false
+		case 1:
+			return false, false, false
+		}
+	}
+
+	return lower, upper, true
+}
+
+// compareBound compares a node's prefix against the remainder of a range bound.
+// it returns -1 if every key under the node sorts before the bound, 1 if they all
+// sort after it, or 0 if the node's key is still a prefix of the bound
+func compareBound(prefix, bound []byte) int {
+	m := len(prefix)
+	if len(bound) < m {
+		m = len(bound)
+	}
+
+	c := bytes.Compare(prefix[:m], bound[:m])
+	if c != 0 {
+		return c
+	}
+
+	if len(prefix) > len(bound) {
+		return 1
+	}
+
+	return 0
+}
+
+// childKey returns the full key of a child node
+func childKey(key []byte, b byte, next *node) []byte {
+	ckey := make([]byte, len(key), len(key)+len(next.prefix)+1)
+	copy(ckey, key)
+
+	ckey = append(ckey, b)
+	ckey = append(ckey, next.prefix...)
+
+	return ckey
+}
+
+// prefixEnd returns the first key that sorts after all keys
+// with the given prefix, or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 255 {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+
+	return nil
 }
@@ -2,11 +2,22 @@ package art
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
 	"sync/atomic"
 	"unsafe"
 )
 
+const (
+	// the number of bits of a node's size used to store the size. the next
+	// bit is set once the size has been counted, and the remaining bits are
+	// used to version the size
+	sizeBits    = 40
+	sizeMask    = 1<<sizeBits - 1
+	sizeCounted = 1 << sizeBits
+	sizeVersion = sizeBits + 1
+)
+
 const (
 	NodeLeaf = iota
 	Node4
@@ -16,9 +27,23 @@ const (
 )
 
 type node struct {
+	// the number of keys stored under the node's edges, if they've been
+	// counted, along with a version that's updated when a key under the
+	// node changes. the root's size isn't kept up to date
+	size   uint64
 	prefix []byte
 	value  Comparable
 	edges  *unsafe.Pointer
+	// the digest of the keys under the node, if it has been hashed
+	hash unsafe.Pointer
+	// the generation of the tree the node belongs to. a tree only changes
+	// the edges of its own nodes, so nodes from another generation can be
+	// shared with clones of the tree, and are copied before being changed
+	gen uint64
+	// the version of the last write to change the keys under the node
+	// while a snapshot was in use. snapshots taken after it see the
+	// same keys under the node, as long as the node is in both
+	changed uint64
 }
 
 func newNode(size int, prefix []byte, value Comparable) *node {
@@ -46,11 +71,17 @@ func newNode(size int, prefix []byte, value Comparable) *node {
 }
 
 func (n *node) next(b byte) *node {
-	return (*(*edges)(atomic.LoadPointer(n.edges))).next(b)
+	return n.getEdges().next(b)
 }
 
-func (n *node) swapNext(b byte, existing, next *node) bool {
-	e := (*edges)(atomic.LoadPointer(n.edges))
+// swapNext replaces the node's edge for a given byte if it's still set to existing.
+// if the write was started while a snapshot was in use, the new edges are published
+// as a new version of the node's edges, so the snapshot can still read the old version
+func (n *node) swapNext(b byte, existing, next *node, w *write) bool {
+	e, ok := n.load(w)
+	if !ok {
+		return false
+	}
 
 	/*
 		if (*e).ntype() == NodeLeaf {
@@ -73,15 +104,142 @@ func (n *node) swapNext(b byte, existing, next *node) bool {
 
 	var ne edges
 
-	if (*e).full() && (*e).next(b) == nil {
+	switch {
+	case next == nil:
+		ne = (*e).copy()
+		ne.remove(b)
+
+		if ne.sparse() {
+			ne = ne.downgrade()
+		}
+	case (*e).full() && cn == nil:
 		ne = (*e).upgrade()
-	} else {
+		ne.setNext(b, next)
+	default:
 		ne = (*e).copy()
+		ne.setNext(b, next)
 	}
 
-	ne.setNext(b, next)
+	var v *edgesVersion
 
-	return atomic.CompareAndSwapPointer(n.edges, unsafe.Pointer(e), unsafe.Pointer(&ne))
+	switch {
+	case w == nil:
+	case w.txn != nil:
+		// the edges aren't visible until the transaction is committed
+		v = &edgesVersion{
+			edges:    ne,
+			previous: unsafe.Pointer(e),
+			txn:      w.txn,
+		}
+	case w.versioned:
+		v = &edgesVersion{
+			edges:    ne,
+			version:  w.version,
+			previous: unsafe.Pointer(e),
+		}
+	}
+
+	if v != nil {
+		ne = v
+	}
+
+	if !atomic.CompareAndSwapPointer(n.edges, unsafe.Pointer(e), unsafe.Pointer(&ne)) {
+		return false
+	}
+
+	switch {
+	case v == nil:
+	case v.txn != nil:
+		v.txn.staged(n, v)
+	default:
+		w.clock.publish(v)
+	}
+
+	return true
+}
+
+// hold publishes the node's edges unchanged as part of a transaction if its edge
+// for a given byte is still set to existing, so any other write to the edges
+// waits until the transaction has been committed
+func (n *node) hold(b byte, existing *node, w *write) bool {
+	e, ok := n.load(w)
+	if !ok || (*e).next(b) != existing {
+		return false
+	}
+
+	current := *e
+
+	if v, versioned := current.(*edgesVersion); versioned {
+		if v.txn == w.txn {
+			return true
+		}
+
+		current = v.edges
+	}
+
+	v := &edgesVersion{
+		edges:    current,
+		previous: unsafe.Pointer(e),
+		txn:      w.txn,
+	}
+
+	var ne edges = v
+
+	if !atomic.CompareAndSwapPointer(n.edges, unsafe.Pointer(e), unsafe.Pointer(&ne)) {
+		return false
+	}
+
+	w.txn.staged(n, v)
+
+	return true
+}
+
+// load returns the node's edges so they can be swapped for new ones. if another
+// transaction has changed them and is being committed, a transaction will fail,
+// while any other write waits for it to finish. frozen edges can't be swapped
+func (n *node) load(w *write) (*edges, bool) {
+	for {
+		e := (*edges)(atomic.LoadPointer(n.edges))
+
+		switch v := (*e).(type) {
+		case *edgesFrozen:
+			return nil, false
+		case *edgesVersion:
+			if v.txn == nil || v.committed() || w != nil && v.txn == w.txn {
+				return e, true
+			}
+
+			if w != nil && w.txn != nil {
+				return nil, false
+			}
+
+			runtime.Gosched()
+		default:
+			return e, true
+		}
+	}
+}
+
+// freeze stops any further changes being made to the node's edges,
+// returning the edges that were frozen
+func (n *node) freeze() (*edges, bool) {
+	e, ok := n.load(nil)
+	if !ok {
+		return nil, false
+	}
+
+	var fe edges = &edgesFrozen{*e}
+
+	if !atomic.CompareAndSwapPointer(n.edges, unsafe.Pointer(e), unsafe.Pointer(&fe)) {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// thaw restores edges that were frozen by a call to freeze
+func (n *node) thaw(e *edges) {
+	atomic.StorePointer(n.edges, unsafe.Pointer(e))
 }
 
 func (n *node) setNext(b byte, next *node) {
@@ -100,8 +258,131 @@ func (n *node) setNext(b byte, next *node) {
 	*e = newEdges
 }
 
+// getEdges returns the node's edges, without any changes made
+// by transactions that are still being committed
 func (n *node) getEdges() edges {
-	return (*(*edges)(atomic.LoadPointer(n.edges)))
+	return n.getEdgesIn(nil)
+}
+
+// getEdgesIn returns the node's edges, including any changes
+// made by a transaction that's still being committed
+func (n *node) getEdgesIn(txn *commit) edges {
+	e := *(*edges)(atomic.LoadPointer(n.edges))
+
+	for {
+		v, versioned := e.(*edgesVersion)
+		if !versioned || v.txn == nil || v.txn == txn || v.committed() {
+			return e
+		}
+
+		e = *(*edges)(atomic.LoadPointer(&v.previous))
+	}
+}
+
+// getEdgesAt returns the newest version of the node's edges
+// that was published before the given version of the tree
+func (n *node) getEdgesAt(version uint64) edges {
+	e := *(*edges)(atomic.LoadPointer(n.edges))
+
+	if f, frozen := e.(*edgesFrozen); frozen {
+		e = f.edges
+	}
+
+	for {
+		v, versioned := e.(*edgesVersion)
+		if !versioned {
+			// the edges have been unchanged since before the version
+			return e
+		}
+
+		if v.stamp() < version {
+			return v.edges
+		}
+
+		p := atomic.LoadPointer(&v.previous)
+		if p == nil {
+			// previous versions are only dropped once every snapshot
+			// that could read them has been released
+			panic("art: snapshot read a version of the tree that has been released")
+		}
+
+		e = *(*edges)(p)
+	}
+}
+
+// getSize returns the number of keys stored under the node. the keys are counted
+// from the totals of the node's children the first time the size is needed after
+// a key under the node has changed, and the count is kept until another one does
+func (n *node) getSize() uint64 {
+	// load the size before the edges, so if a key under the node changes
+	// after we've counted it, the version will have changed and our count
+	// won't be kept
+	s := atomic.LoadUint64(&n.size)
+
+	if s&sizeCounted != 0 {
+		return s & sizeMask
+	}
+
+	e := n.getEdges()
+
+	var size uint64
+
+	for i := 0; i < 256; i++ {
+		b, next := e.ceiling(byte(i))
+		if next == nil {
+			break
+		}
+
+		i = int(b)
+		size = size + next.total()
+	}
+
+	atomic.CompareAndSwapUint64(&n.size, s, s|sizeCounted|size)
+
+	return size
+}
+
+// total returns the number of keys stored under the node, including its own
+func (n *node) total() uint64 {
+	if n.value != nil {
+		return n.getSize() + 1
+	}
+
+	return n.getSize()
+}
+
+// version returns the version of the node's size
+func (n *node) version() uint64 {
+	return atomic.LoadUint64(&n.size) >> sizeVersion
+}
+
+// invalidate bumps the version of the node's size and discards its count,
+// so the node's keys are counted again and any digest cached for it isn't used
+func (n *node) invalidate() {
+	for {
+		s := atomic.LoadUint64(&n.size)
+
+		if atomic.CompareAndSwapUint64(&n.size, s, (s>>sizeVersion+1)<<sizeVersion) {
+			return
+		}
+	}
+}
+
+// mark records that the keys under the node were changed by a write at the given version
+func (n *node) mark(version uint64) {
+	for {
+		c := atomic.LoadUint64(&n.changed)
+
+		if c >= version || atomic.CompareAndSwapUint64(&n.changed, c, version) {
+			return
+		}
+	}
+}
+
+// unchanged returns true if none of the keys under the node have
+// been changed by a write at or after the given version
+func (n *node) unchanged(version uint64) bool {
+	return atomic.LoadUint64(&n.changed) < version
 }
 
 func (n *node) print() {
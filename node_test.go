@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNodeSetNext(t *testing.T) {
@@ -199,7 +200,101 @@ func TestNode256SetNext(t *testing.T) {
 	assert.NotNil(t, n.getEdges().(*edges256).edges[99])
 	assert.Nil(t, n.getEdges().(*edges256).edges[3])
 
-	assert.Equal(t, uint8(3), n.getEdges().(*edges256).children)
+	assert.Equal(t, uint16(3), n.getEdges().(*edges256).children)
+}
+
+func TestNode4Remove(t *testing.T) {
+	n := newNode(Node4, nil, nil)
+
+	n.setNext(b("a"), newNode(Node4, nil, nil))
+	n.setNext(b("b"), newNode(Node4, nil, nil))
+	n.setNext(b("c"), newNode(Node4, nil, nil))
+
+	n.getEdges().remove(b("b"))
+
+	assert.Equal(t, b("a"), n.getEdges().(*edges4).keys[0])
+	assert.Equal(t, b("c"), n.getEdges().(*edges4).keys[1])
+	assert.Nil(t, n.getEdges().(*edges4).edges[2])
+	assert.Nil(t, n.next(b("b")))
+	assert.Equal(t, uint8(2), n.getEdges().(*edges4).children)
+
+	// removing a missing key should do nothing
+	n.getEdges().remove(b("d"))
+	assert.Equal(t, uint8(2), n.getEdges().(*edges4).children)
+}
+
+func TestNode48Remove(t *testing.T) {
+	n := newNode(Node48, nil, nil)
+
+	for i := 0; i < 20; i++ {
+		n.setNext(byte(i), newNode(Node4, []byte{byte(i)}, nil))
+	}
+
+	n.getEdges().remove(byte(5))
+
+	assert.Nil(t, n.next(byte(5)))
+	assert.Equal(t, uint8(19), n.getEdges().(*edges48).children)
+	assert.Nil(t, n.getEdges().(*edges48).edges[19])
+
+	for i := 0; i < 20; i++ {
+		if i == 5 {
+			continue
+		}
+
+		require.NotNil(t, n.next(byte(i)))
+		assert.Equal(t, []byte{byte(i)}, n.next(byte(i)).prefix)
+	}
+}
+
+func TestNodeSwapNextDowngrade(t *testing.T) {
+	n := newNode(Node256, nil, nil)
+
+	children := make([]*node, 256)
+
+	for i := 0; i < 256; i++ {
+		children[i] = newNode(Node4, []byte{byte(i)}, nil)
+		require.True(t, n.swapNext(byte(i), nil, children[i], nil))
+	}
+
+	sizes := map[int]uint8{
+		200: Node256,
+		37:  Node48,
+		12:  Node16,
+		3:   Node4,
+		0:   NodeLeaf,
+	}
+
+	for i := 0; i < 256; i++ {
+		require.True(t, n.swapNext(byte(i), children[i], nil, nil))
+
+		remaining := 255 - i
+
+		if size, ok := sizes[remaining]; ok {
+			assert.Equal(t, size, n.getEdges().ntype())
+			assert.Equal(t, remaining, n.getEdges().count())
+		}
+
+		for x := i + 1; x < 256; x++ {
+			require.Equal(t, children[x], n.next(byte(x)))
+		}
+	}
+}
+
+func TestNodeFreeze(t *testing.T) {
+	n := newNode(Node4, nil, nil)
+
+	e, ok := n.freeze()
+	require.True(t, ok)
+
+	_, ok = n.freeze()
+	assert.False(t, ok)
+
+	assert.False(t, n.swapNext(b("a"), nil, newNode(Node4, nil, nil), nil))
+
+	n.thaw(e)
+
+	assert.True(t, n.swapNext(b("a"), nil, newNode(Node4, nil, nil), nil))
+	assert.NotNil(t, n.next(b("a")))
 }
 
 func b(s string) byte {
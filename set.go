@@ -0,0 +1,79 @@
+package art
+
+// Union creates a new tree containing the keys that are in either tree. Keys that are in
+// both trees have their value set to the value returned by fn, or are left out of the new
+// tree if fn returns nil. If fn is nil, the value from b is used. Both trees are walked in
+// parallel from snapshots, so the new tree is built from their keys at a single point in time
+func Union(a, b *ART, fn func(key []byte, a, b Comparable) Comparable) *ART {
+	return combine(a, b, true, true, func(key []byte, va, vb Comparable) Comparable {
+		switch {
+		case va == nil:
+			return vb
+		case vb == nil:
+			return va
+		}
+
+		return resolve(key, va, vb, fn)
+	})
+}
+
+// Intersect creates a new tree containing the keys that are in both trees, with their
+// value set to the value returned by fn, or left out of the new tree if fn returns nil.
+// If fn is nil, the value from b is used. Subtrees that are only in one of the trees are
+// skipped without visiting any of their keys
+func Intersect(a, b *ART, fn func(key []byte, a, b Comparable) Comparable) *ART {
+	return combine(a, b, false, false, func(key []byte, va, vb Comparable) Comparable {
+		return resolve(key, va, vb, fn)
+	})
+}
+
+// Subtract creates a new tree containing the keys in a that are not in b. Subtrees
+// that are only in b are skipped without visiting any of their keys
+func Subtract(a, b *ART) *ART {
+	return combine(a, b, true, false, func(key []byte, va, vb Comparable) Comparable {
+		if vb != nil {
+			return nil
+		}
+
+		return va
+	})
+}
+
+// resolve returns the value of a key that's in both trees
+func resolve(key []byte, va, vb Comparable, fn func(key []byte, a, b Comparable) Comparable) Comparable {
+	if fn == nil {
+		return vb
+	}
+
+	return fn(key, va, vb)
+}
+
+// combine builds a new tree from the keys in two trees, with the values returned by fn.
+// left and right set whether keys that are only in a or only in b are visited
+func combine(a, b *ART, left, right bool, fn func(key []byte, va, vb Comparable) Comparable) *ART {
+	sa, sb := a.Snapshot(), b.Snapshot()
+	defer sa.Release()
+	defer sb.Release()
+
+	t := New()
+	l := newLoader(t.gen)
+
+	w := walker{
+		a:     sa.tree,
+		b:     sb.tree,
+		left:  left,
+		right: right,
+		fn: func(key []byte, va, vb Comparable) {
+			value := fn(key, va, vb)
+			if value != nil {
+				l.add(key, value)
+			}
+		},
+	}
+
+	w.walk()
+
+	t.load(l.finish())
+
+	return t
+}
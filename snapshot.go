@@ -0,0 +1,383 @@
+package art
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ReadOnlyART is an immutable view of a tree at the point in time a snapshot
+// of it was taken. Changes made to the tree after the snapshot was taken are
+// not visible through the view
+type ReadOnlyART struct {
+	tree     *ART
+	released int32
+}
+
+// clock tracks the version of a tree, along with
+// the versions its snapshots are reading from
+type clock struct {
+	mu sync.Mutex
+	// the current version of the tree
+	version uint64
+	// the oldest version still being read by a snapshot
+	oldest uint64
+	// the number of snapshots reading from each version
+	snapshots map[uint64]int
+	// the number of writes in progress. while the epoch is odd, the tree is
+	// paused, and writes wait for it to be resumed before they can start
+	epoch   uint64
+	writers int64
+	// versions of edges whose previous versions are kept for a snapshot.
+	// they're dropped once the snapshots that need them are released
+	retired unsafe.Pointer
+}
+
+// write is a change being made to a tree. a snapshot waits for any writes
+// that are in progress when it's taken, so a write's changes are either all
+// visible to the snapshot or none of them are
+type write struct {
+	clock *clock
+	// the version of the tree when the write started.
+	// the edges it publishes are stamped with it
+	version uint64
+	// true if a snapshot was in use when the write started,
+	// so the edges it replaces must be kept for it
+	versioned bool
+	// the transaction the write is part of, if any
+	txn *commit
+}
+
+// edgesVersion is a version of a node's edges. reads pass through to the wrapped
+// edges, while snapshots follow previous back to the newest version of the edges
+// that was published before the snapshot was taken
+type edgesVersion struct {
+	edges
+	version  uint64
+	previous unsafe.Pointer
+	// the transaction that published the edges, if
+	// they're stamped with the version it's committed at
+	txn *commit
+	// the next version on the clock's list of retired versions
+	retired *edgesVersion
+}
+
+func newClock() *clock {
+	return &clock{
+		oldest:    math.MaxUint64,
+		snapshots: make(map[uint64]int),
+	}
+}
+
+// Snapshot takes a consistent, point in time view of the tree. Writes that have
+// completed before the snapshot is taken are visible through it, while writes
+// made afterwards are not. Taking a snapshot waits for any writes in progress to
+// finish. The snapshot should be released once it's no longer needed, so the old
+// versions of the tree it refers to can be freed
+func (t *ART) Snapshot() *ReadOnlyART {
+	return &ReadOnlyART{
+		tree: &ART{
+			root:    t.root,
+			clock:   t.clock,
+			version: t.clock.acquire(),
+		},
+	}
+}
+
+// acquire increments the tree's version, returning the new version. all
+// edges stamped with an earlier version are visible to readers of it
+func (c *clock) acquire() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v := c.version + 1
+
+	c.snapshots[v]++
+
+	// writes in progress are stamped with an earlier version, so wait for them to
+	// finish before publishing the new one. writes started afterwards are stamped
+	// with the new version, and will see that it's in use
+	c.pause()
+
+	if v < c.oldest {
+		atomic.StoreUint64(&c.oldest, v)
+	}
+
+	atomic.StoreUint64(&c.version, v)
+
+	c.resume()
+
+	return v
+}
+
+// release removes a snapshot's version from the versions that are in use,
+// dropping any previous versions of edges that are no longer needed
+func (c *clock) release(version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.snapshots[version]--
+
+	if c.snapshots[version] > 0 {
+		return
+	}
+
+	delete(c.snapshots, version)
+
+	oldest := uint64(math.MaxUint64)
+
+	for v := range c.snapshots {
+		if v < oldest {
+			oldest = v
+		}
+	}
+
+	atomic.StoreUint64(&c.oldest, oldest)
+
+	v := (*edgesVersion)(atomic.SwapPointer(&c.retired, nil))
+
+	for v != nil {
+		next := v.retired
+
+		if v.stamp() < oldest {
+			atomic.StorePointer(&v.previous, nil)
+		} else {
+			c.retire(v)
+		}
+
+		v = next
+	}
+}
+
+// pause waits for the writes in progress to finish, stopping
+// any more from starting until resume is called. c.mu must be held
+func (c *clock) pause() {
+	atomic.AddUint64(&c.epoch, 1)
+
+	for atomic.LoadInt64(&c.writers) > 0 {
+		runtime.Gosched()
+	}
+}
+
+// resume lets writes start again after a pause
+func (c *clock) resume() {
+	atomic.AddUint64(&c.epoch, 1)
+}
+
+// lock pauses the tree, returning a write that can change
+// it while no other writes are in progress
+func (c *clock) lock() write {
+	c.mu.Lock()
+	c.pause()
+
+	return write{
+		clock:     c,
+		version:   c.version,
+		versioned: c.oldest != math.MaxUint64,
+	}
+}
+
+// unlock resumes the tree after it was paused by lock
+func (c *clock) unlock() {
+	c.resume()
+	c.mu.Unlock()
+}
+
+// begin starts a write to the tree, waiting for it to be resumed if it's paused
+func (c *clock) begin() write {
+	for {
+		e := atomic.LoadUint64(&c.epoch)
+
+		if e&1 == 1 {
+			runtime.Gosched()
+			continue
+		}
+
+		atomic.AddInt64(&c.writers, 1)
+
+		// if the tree was paused before we were counted,
+		// whoever paused it may not have waited for us
+		if atomic.LoadUint64(&c.epoch) == e {
+			return write{
+				clock:     c,
+				version:   atomic.LoadUint64(&c.version),
+				versioned: atomic.LoadUint64(&c.oldest) != math.MaxUint64,
+			}
+		}
+
+		atomic.AddInt64(&c.writers, -1)
+	}
+}
+
+// end finishes a write to the tree
+func (c *clock) end(w *write) {
+	atomic.AddInt64(&c.writers, -1)
+}
+
+// publish keeps the previous version of edges that have been swapped into a node
+// for the snapshots that need it. if every snapshot that was in use when they were
+// published has since been released, the previous version is dropped straight away
+func (c *clock) publish(v *edgesVersion) {
+	// a snapshot taken since the write started will have a later version
+	// than the edges, so the oldest version can only be after them once the
+	// snapshots that might need the previous version have been released
+	if v.stamp() < atomic.LoadUint64(&c.oldest) {
+		atomic.StorePointer(&v.previous, nil)
+		return
+	}
+
+	c.retire(v)
+
+	// the last of the snapshots may have been released
+	// before the version was added to the retired list
+	if v.stamp() < atomic.LoadUint64(&c.oldest) {
+		atomic.StorePointer(&v.previous, nil)
+	}
+}
+
+// stamp returns the version the edges were published at
+func (v *edgesVersion) stamp() uint64 {
+	if v.txn != nil {
+		return atomic.LoadUint64(&v.txn.version)
+	}
+
+	return v.version
+}
+
+// committed returns false if the edges were published by
+// a transaction that hasn't been committed yet
+func (v *edgesVersion) committed() bool {
+	return v.txn == nil || atomic.LoadUint64(&v.txn.version) != uncommitted
+}
+
+// retire adds a version to the list of versions whose previous
+// version is dropped once it's no longer read by a snapshot
+func (c *clock) retire(v *edgesVersion) {
+	for {
+		head := atomic.LoadPointer(&c.retired)
+		v.retired = (*edgesVersion)(head)
+
+		if atomic.CompareAndSwapPointer(&c.retired, head, unsafe.Pointer(v)) {
+			return
+		}
+	}
+}
+
+// Release frees the snapshot. It must not be used after it has been released
+func (r *ReadOnlyART) Release() {
+	if atomic.CompareAndSwapInt32(&r.released, 0, 1) {
+		r.tree.clock.release(r.tree.version)
+	}
+}
+
+// Clone creates a new tree containing the keys in the snapshot
+func (r *ReadOnlyART) Clone() *ART {
+	gen := atomic.AddUint64(&generation, 1)
+	root := r.tree.copyNode(r.tree.root, gen)
+
+	return &ART{
+		size:  int64(root.getSize()),
+		root:  root,
+		clock: newClock(),
+		gen:   gen,
+	}
+}
+
+// Lookup a value from the snapshot
+func (r *ReadOnlyART) Lookup(key []byte) interface{} {
+	return r.tree.Lookup(key)
+}
+
+// LongestPrefix returns the longest key in the snapshot that is a prefix of the given key
+func (r *ReadOnlyART) LongestPrefix(key []byte) ([]byte, Comparable, bool) {
+	return r.tree.LongestPrefix(key)
+}
+
+// Prefixes calls fn for every key in the snapshot that is a prefix of the given key
+func (r *ReadOnlyART) Prefixes(key []byte, fn func(key []byte, value Comparable) bool) {
+	r.tree.Prefixes(key, fn)
+}
+
+// RootHash returns a hash of all of the keys and values in the snapshot.
+// Hashes of a snapshot are not cached, so every node is hashed
+func (r *ReadOnlyART) RootHash() ([]byte, error) {
+	return r.tree.RootHash()
+}
+
+// SubtreeHash returns a hash of all of the keys in the snapshot with the given prefix and their values
+func (r *ReadOnlyART) SubtreeHash(prefix []byte) ([]byte, error) {
+	return r.tree.SubtreeHash(prefix)
+}
+
+// Min returns the smallest key in the snapshot and its value
+func (r *ReadOnlyART) Min() ([]byte, Comparable, bool) {
+	return r.tree.Min()
+}
+
+// Max returns the largest key in the snapshot and its value
+func (r *ReadOnlyART) Max() ([]byte, Comparable, bool) {
+	return r.tree.Max()
+}
+
+// MinPrefix returns the smallest key with the given prefix and its value
+func (r *ReadOnlyART) MinPrefix(prefix []byte) ([]byte, Comparable, bool) {
+	return r.tree.MinPrefix(prefix)
+}
+
+// MaxPrefix returns the largest key with the given prefix and its value
+func (r *ReadOnlyART) MaxPrefix(prefix []byte) ([]byte, Comparable, bool) {
+	return r.tree.MaxPrefix(prefix)
+}
+
+// Floor returns the largest key that is less than or equal to the given key
+func (r *ReadOnlyART) Floor(key []byte) ([]byte, Comparable, bool) {
+	return r.tree.Floor(key)
+}
+
+// Ceiling returns the smallest key that is greater than or equal to the given key
+func (r *ReadOnlyART) Ceiling(key []byte) ([]byte, Comparable, bool) {
+	return r.tree.Ceiling(key)
+}
+
+// Predecessor returns the largest key that is less than the given key
+func (r *ReadOnlyART) Predecessor(key []byte) ([]byte, Comparable, bool) {
+	return r.tree.Predecessor(key)
+}
+
+// Successor returns the smallest key that is greater than the given key
+func (r *ReadOnlyART) Successor(key []byte) ([]byte, Comparable, bool) {
+	return r.tree.Successor(key)
+}
+
+// Iterate over every key in the snapshot that starts with a given prefix
+func (r *ReadOnlyART) Iterate(from []byte, fn func(key []byte, value Comparable)) {
+	r.tree.Iterate(from, fn)
+}
+
+// Walk iterates over every key in the snapshot that starts with a given prefix,
+// stopping and returning the first error returned by fn
+func (r *ReadOnlyART) Walk(from []byte, fn func(key []byte, value Comparable) error) error {
+	return r.tree.Walk(from, fn)
+}
+
+// IterateReverse iterates over every key with a given prefix in descending order
+func (r *ReadOnlyART) IterateReverse(prefix []byte, fn func(key []byte, value Comparable)) {
+	r.tree.IterateReverse(prefix, fn)
+}
+
+// Range iterates over every key in the snapshot in order from start up to, but not including end
+func (r *ReadOnlyART) Range(start, end []byte, fn func(key []byte, value Comparable) bool) {
+	r.tree.Range(start, end, fn)
+}
+
+// RangeReverse iterates over every key in the snapshot in descending order from the last key before end down to start
+func (r *ReadOnlyART) RangeReverse(start, end []byte, fn func(key []byte, value Comparable) bool) {
+	r.tree.RangeReverse(start, end, fn)
+}
+
+// Cursor creates a new cursor for the snapshot
+func (r *ReadOnlyART) Cursor() *Cursor {
+	return r.tree.Cursor()
+}
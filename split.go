@@ -0,0 +1,119 @@
+package art
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrOverlap is returned when joining trees whose keys are not in separate ranges
+var ErrOverlap = errors.New("keys of the trees must not overlap")
+
+// SplitAt moves every key from the given key onwards into a new tree, returning the tree,
+// which is left with the keys before the given key, and the new tree. Writes to the tree
+// wait while it's being split, so the keys are moved atomically, and any key added once it
+// has been split stays in the tree. Subtrees that are entirely after the key are unlinked
+// from the tree and added to the new tree without being copied, so splitting takes time
+// proportional to the number of subtrees moved, rather than the number of keys
+func (t *ART) SplitAt(key []byte) (*ART, *ART) {
+	var keys [][]byte
+	var subtrees []bool
+
+	w := t.clock.lock()
+
+	// the new tree shares the clock, as the edges of the nodes moved to it are
+	// versioned by it, and the generation, as the nodes still belong to a tree
+	upper := &ART{
+		root:  newNode(Node256, nil, nil),
+		clock: t.clock,
+		gen:   t.gen,
+	}
+
+	upper.root.gen = upper.gen
+
+	l := newLoader(upper.gen)
+
+	t.rangeSubtrees(nil, t.root, key, nil, true, false, func(key []byte, subtree bool) {
+		keys = append(keys, key)
+		subtrees = append(subtrees, subtree)
+	})
+
+	for i := range keys {
+		if subtrees[i] {
+			t.move(keys[i], l, &w)
+			continue
+		}
+
+		parent, current, pos, dv := t.own(keys[i], &w)
+
+		if current == nil || !shouldUpdate(keys[i], current, parent, pos, dv) || current.value == nil {
+			continue
+		}
+
+		if t.deleteNode(keys[i], parent, current, pos, dv, &w) {
+			t.compact(keys[i][:pos-(len(current.prefix)+1)], &w)
+			l.add(keys[i], current.value)
+		}
+	}
+
+	t.clock.unlock()
+
+	// the new tree can't be seen by anyone else yet,
+	// so the moved keys can be added once writes resume
+	upper.load(l.finish())
+
+	return t, upper
+}
+
+// move unlinks the subtree holding a prefix and adds it to the loader. the tree must be paused
+func (t *ART) move(prefix []byte, l *loader, w *write) {
+	if len(prefix) < 1 {
+		// the root can't be unlinked, so move each of its edges in turn
+		for i := 0; i < 256; i++ {
+			t.move([]byte{byte(i)}, l, w)
+		}
+
+		return
+	}
+
+	key, n := t.detachPrefix(prefix, w)
+
+	if n != nil {
+		atomic.AddInt64(&t.size, -int64(n.total()))
+		l.addNode(key, n)
+	}
+}
+
+// Join adds every key from another tree, whose keys must either all be before or all
+// be after the keys in this tree. Every node of the other tree is copied from a snapshot,
+// so joining takes time proportional to the number of keys in it, and the copies are then
+// added to the tree a subtree at a time. The other tree is unchanged. If the keys of the
+// trees overlap, ErrOverlap is returned
+func (t *ART) Join(other *ART) error {
+	s := other.Snapshot()
+	defer s.Release()
+
+	tmin, _, ok := t.Min()
+	tmax, _, _ := t.Max()
+	omin, _, ook := s.Min()
+	omax, _, _ := s.Max()
+
+	if ok && ook && bytes.Compare(omin, tmax) <= 0 && bytes.Compare(omax, tmin) >= 0 {
+		return ErrOverlap
+	}
+
+	e := s.tree.copyNode(s.tree.root, atomic.LoadUint64(&t.gen)).getEdges()
+
+	for i := 0; i < 256; i++ {
+		b, next := e.ceiling(byte(i))
+		if next == nil {
+			break
+		}
+
+		i = int(b)
+
+		t.graft(childKey(nil, b, next), 0, next)
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package art
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"sort"
+	"sync/atomic"
+)
+
+// the version of a transaction that hasn't been committed yet
+const uncommitted = math.MaxUint64
+
+var (
+	// ErrConflict is returned when a transaction can't be committed, as a key
+	// it has read or written has been changed since the transaction started
+	ErrConflict = errors.New("transaction conflicts with a concurrent change")
+	// ErrTxnDone is returned when committing a transaction that has
+	// already been committed or discarded
+	ErrTxnDone = errors.New("transaction has already been committed or discarded")
+)
+
+// Txn is a set of changes to a tree that are committed atomically. Keys are read from
+// a snapshot of the tree taken when the transaction started, along with any changes
+// made by the transaction itself. A transaction must be committed or discarded, so the
+// snapshot it reads from is released. A Txn is not safe for concurrent use
+type Txn struct {
+	tree     *ART
+	snapshot *ReadOnlyART
+	// the values of keys read or written, as they were when the transaction started
+	reads  map[string]Comparable
+	writes map[string]Comparable
+	done   bool
+}
+
+// Txn starts a new transaction
+func (t *ART) Txn() *Txn {
+	return &Txn{
+		tree:     t,
+		snapshot: t.Snapshot(),
+		reads:    make(map[string]Comparable),
+		writes:   make(map[string]Comparable),
+	}
+}
+
+// Get returns the value of a key
+func (tx *Txn) Get(key []byte) Comparable {
+	value, ok := tx.writes[string(key)]
+	if ok {
+		return value
+	}
+
+	return tx.read(key)
+}
+
+// Put sets the value of a key when the transaction is committed
+func (tx *Txn) Put(key []byte, value Comparable) {
+	tx.read(key)
+	tx.writes[string(key)] = value
+}
+
+// Delete removes a key when the transaction is committed
+func (tx *Txn) Delete(key []byte) {
+	tx.Put(key, nil)
+}
+
+// Commit applies the transaction's changes to the tree. If any of the keys read or
+// written by the transaction have changed since it started, no changes are made and
+// ErrConflict is returned. The changes are staged as versions of the edges they change,
+// which are all made visible in a single step, so readers and snapshots of the tree see
+// all of a transaction's changes or none of them. Other writes to the keys wait while
+// a transaction is being committed, while other transactions using them fail
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+
+	tx.done = true
+
+	defer tx.snapshot.Release()
+
+	keys := make([]string, 0, len(tx.reads))
+
+	for key := range tx.reads {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	c := &commit{version: uncommitted}
+
+	w := tx.tree.clock.begin()
+	w.txn = c
+
+	// a view of the tree that includes the changes staged by the transaction
+	staged := &ART{root: tx.tree.root, clock: tx.tree.clock, txn: c, gen: tx.tree.gen}
+
+	if !tx.hold(staged, keys, &w) || !tx.stage(staged, keys, &w) {
+		c.abort()
+		tx.tree.clock.end(&w)
+		return ErrConflict
+	}
+
+	atomic.StoreUint64(&c.version, w.version)
+
+	for _, v := range c.versions {
+		w.clock.publish(v)
+	}
+
+	atomic.AddInt64(&tx.tree.size, staged.size)
+
+	for _, key := range keys {
+		if _, ok := tx.writes[key]; ok {
+			tx.tree.invalidate([]byte(key), &w)
+		}
+	}
+
+	tx.tree.clock.end(&w)
+
+	// remove the nodes left without a value by the keys that were deleted
+	for _, key := range keys {
+		value, ok := tx.writes[key]
+		if !ok || value != nil || len(key) == 0 {
+			continue
+		}
+
+		w := tx.tree.clock.begin()
+		tx.tree.compact([]byte(key), &w)
+		tx.tree.clock.end(&w)
+	}
+
+	return nil
+}
+
+// Discard abandons the transaction without applying any of its changes
+func (tx *Txn) Discard() {
+	if tx.done {
+		return
+	}
+
+	tx.done = true
+	tx.snapshot.Release()
+}
+
+// read returns the value of a key from the transaction's snapshot,
+// recording it so it can be checked when the transaction is committed
+func (tx *Txn) read(key []byte) Comparable {
+	value, ok := tx.reads[string(key)]
+	if ok {
+		return value
+	}
+
+	value, _ = tx.snapshot.Lookup(key).(Comparable)
+	tx.reads[string(key)] = value
+
+	return value
+}
+
+// hold stops any other writes to the edges holding each key until the transaction
+// has been committed, then checks the keys haven't changed since it started
+func (tx *Txn) hold(staged *ART, keys []string, w *write) bool {
+	for _, key := range keys {
+		k := []byte(key)
+
+		for {
+			var b byte
+			var value Comparable
+
+			parent, current, pos, dv := staged.own(k, w)
+
+			switch {
+			case current == nil:
+				b = k[pos]
+			case shouldUpdate(k, current, parent, pos, dv):
+				b = k[pos-(len(current.prefix)+1)]
+				value = current.value
+			default:
+				b = k[pos-1]
+			}
+
+			if _, ok := parent.load(w); !ok {
+				// another transaction is using the key
+				return false
+			}
+
+			if !parent.hold(b, current, w) {
+				runtime.Gosched()
+				continue
+			}
+
+			if !equal(value, tx.reads[key]) {
+				return false
+			}
+
+			break
+		}
+	}
+
+	return true
+}
+
+// stage makes the transaction's changes, which are only
+// visible to the staged tree until they're committed
+func (tx *Txn) stage(staged *ART, keys []string, w *write) bool {
+	for _, key := range keys {
+		value, ok := tx.writes[key]
+		if !ok || value == nil && tx.reads[key] == nil {
+			continue
+		}
+
+		k := []byte(key)
+
+		parent, current, pos, dv := staged.find(k)
+
+		if !staged.store(k, value, parent, current, pos, dv, w) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commit is a transaction that's being committed. the edges it changes are
+// published as versions that are skipped by everyone else until it's given
+// the version of the tree it was committed at
+type commit struct {
+	version uint64
+	// the nodes whose edges were changed, along with the versions of
+	// the edges that were published for them, in the order they were
+	nodes    []*node
+	versions []*edgesVersion
+}
+
+// staged records a version of a node's edges published by the transaction
+func (c *commit) staged(n *node, v *edgesVersion) {
+	c.nodes = append(c.nodes, n)
+	c.versions = append(c.versions, v)
+}
+
+// abort removes the versions of edges published by a transaction that
+// couldn't be committed. nothing else can change the edges while they're
+// versioned by the transaction, so the versions it replaced are restored
+func (c *commit) abort() {
+	for i := len(c.nodes) - 1; i >= 0; i-- {
+		e := atomic.LoadPointer(c.nodes[i].edges)
+
+		for {
+			v, versioned := (*(*edges)(e)).(*edgesVersion)
+			if !versioned || v.txn != c {
+				break
+			}
+
+			e = v.previous
+		}
+
+		atomic.StorePointer(c.nodes[i].edges, e)
+	}
+}
@@ -0,0 +1,258 @@
+package art
+
+import "bytes"
+
+// View is a set of keys that share a prefix, with the prefix implicitly added to every key
+// it's given and stripped from every key it returns. A tree is a view of all of its keys
+type View interface {
+	Insert(key []byte, value Comparable) bool
+	Swap(key []byte, old, new Comparable) bool
+	LoadOrStore(key []byte, value Comparable) (actual Comparable, loaded bool)
+	LoadAndDelete(key []byte) (Comparable, bool)
+	Update(key []byte, fn func(old Comparable, exists bool) (new Comparable, del bool)) Comparable
+	Delete(key []byte) bool
+	CompareAndDelete(key []byte, old Comparable) bool
+	DeletePrefix(prefix []byte) int
+	DeleteRange(start, end []byte) int
+	Len() int
+	CountPrefix(prefix []byte) int
+	Rank(key []byte) int
+	Select(i int) ([]byte, Comparable, bool)
+	Lookup(key []byte) interface{}
+	LongestPrefix(key []byte) ([]byte, Comparable, bool)
+	Prefixes(key []byte, fn func(key []byte, value Comparable) bool)
+	Min() ([]byte, Comparable, bool)
+	Max() ([]byte, Comparable, bool)
+	MinPrefix(prefix []byte) ([]byte, Comparable, bool)
+	MaxPrefix(prefix []byte) ([]byte, Comparable, bool)
+	Floor(key []byte) ([]byte, Comparable, bool)
+	Ceiling(key []byte) ([]byte, Comparable, bool)
+	Predecessor(key []byte) ([]byte, Comparable, bool)
+	Successor(key []byte) ([]byte, Comparable, bool)
+	Iterate(from []byte, fn func(key []byte, value Comparable))
+	Walk(from []byte, fn func(key []byte, value Comparable) error) error
+	IterateReverse(prefix []byte, fn func(key []byte, value Comparable))
+	Range(start, end []byte, fn func(key []byte, value Comparable) bool)
+	RangeReverse(start, end []byte, fn func(key []byte, value Comparable) bool)
+	Sub(prefix []byte) View
+}
+
+// view is a view of the keys in a tree with a given prefix
+type view struct {
+	tree   *ART
+	prefix []byte
+}
+
+// Sub returns a view of the keys with the given prefix. Views can be nested,
+// with the prefix of a view being added to the prefix of the view it's taken from
+func (t *ART) Sub(prefix []byte) View {
+	return &view{
+		tree:   t,
+		prefix: append([]byte{}, prefix...),
+	}
+}
+
+// Sub returns a view of the keys in the view with the given prefix
+func (v *view) Sub(prefix []byte) View {
+	return &view{
+		tree:   v.tree,
+		prefix: v.key(prefix),
+	}
+}
+
+// Insert value into the view
+func (v *view) Insert(key []byte, value Comparable) bool {
+	return v.tree.Insert(v.key(key), value)
+}
+
+// Swap atomically swaps a value
+func (v *view) Swap(key []byte, old, new Comparable) bool {
+	return v.tree.Swap(v.key(key), old, new)
+}
+
+// LoadOrStore returns the existing value for a key if there is one, otherwise it stores the given value
+func (v *view) LoadOrStore(key []byte, value Comparable) (Comparable, bool) {
+	return v.tree.LoadOrStore(v.key(key), value)
+}
+
+// LoadAndDelete removes a key, returning its previous value if there was one
+func (v *view) LoadAndDelete(key []byte) (Comparable, bool) {
+	return v.tree.LoadAndDelete(v.key(key))
+}
+
+// Update atomically updates the value of a key with the result of fn
+func (v *view) Update(key []byte, fn func(old Comparable, exists bool) (new Comparable, del bool)) Comparable {
+	return v.tree.Update(v.key(key), fn)
+}
+
+// Delete removes a key from the view
+func (v *view) Delete(key []byte) bool {
+	return v.tree.Delete(v.key(key))
+}
+
+// CompareAndDelete atomically removes a key if its value matches the old value
+func (v *view) CompareAndDelete(key []byte, old Comparable) bool {
+	return v.tree.CompareAndDelete(v.key(key), old)
+}
+
+// DeletePrefix removes every key in the view that starts with the given prefix
+func (v *view) DeletePrefix(prefix []byte) int {
+	return v.tree.DeletePrefix(v.key(prefix))
+}
+
+// DeleteRange removes every key in the view from start up to, but not including end
+func (v *view) DeleteRange(start, end []byte) int {
+	return v.tree.DeleteRange(v.key(start), v.end(end))
+}
+
+// Len returns the number of keys in the view
+func (v *view) Len() int {
+	return v.tree.CountPrefix(v.prefix)
+}
+
+// CountPrefix returns the number of keys in the view with the given prefix
+func (v *view) CountPrefix(prefix []byte) int {
+	return v.tree.CountPrefix(v.key(prefix))
+}
+
+// Rank returns the number of keys in the view that are less than the given key
+func (v *view) Rank(key []byte) int {
+	return v.tree.Rank(v.key(key)) - v.tree.Rank(v.prefix)
+}
+
+// Select returns the key at the given position in the view's sorted keys
+func (v *view) Select(i int) ([]byte, Comparable, bool) {
+	if i < 0 {
+		return nil, nil, false
+	}
+
+	return v.strip(v.tree.Select(v.tree.Rank(v.prefix) + i))
+}
+
+// Lookup a value from the view
+func (v *view) Lookup(key []byte) interface{} {
+	return v.tree.Lookup(v.key(key))
+}
+
+// LongestPrefix returns the longest key in the view that is a prefix of the given key
+func (v *view) LongestPrefix(key []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.LongestPrefix(v.key(key)))
+}
+
+// Prefixes calls fn for every key in the view that is a prefix of the given key
+func (v *view) Prefixes(key []byte, fn func(key []byte, value Comparable) bool) {
+	v.tree.Prefixes(v.key(key), func(key []byte, value Comparable) bool {
+		if len(key) < len(v.prefix) {
+			// the key is a prefix of the view's prefix
+			return true
+		}
+
+		return fn(key[len(v.prefix):], value)
+	})
+}
+
+// Min returns the smallest key in the view and its value
+func (v *view) Min() ([]byte, Comparable, bool) {
+	return v.MinPrefix(nil)
+}
+
+// Max returns the largest key in the view and its value
+func (v *view) Max() ([]byte, Comparable, bool) {
+	return v.MaxPrefix(nil)
+}
+
+// MinPrefix returns the smallest key in the view with the given prefix and its value
+func (v *view) MinPrefix(prefix []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.MinPrefix(v.key(prefix)))
+}
+
+// MaxPrefix returns the largest key in the view with the given prefix and its value
+func (v *view) MaxPrefix(prefix []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.MaxPrefix(v.key(prefix)))
+}
+
+// Floor returns the largest key in the view that is less than or equal to the given key
+func (v *view) Floor(key []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.Floor(v.key(key)))
+}
+
+// Ceiling returns the smallest key in the view that is greater than or equal to the given key
+func (v *view) Ceiling(key []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.Ceiling(v.key(key)))
+}
+
+// Predecessor returns the largest key in the view that is less than the given key
+func (v *view) Predecessor(key []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.Predecessor(v.key(key)))
+}
+
+// Successor returns the smallest key in the view that is greater than the given key
+func (v *view) Successor(key []byte) ([]byte, Comparable, bool) {
+	return v.strip(v.tree.Successor(v.key(key)))
+}
+
+// Iterate over every key in the view that starts with a given prefix
+func (v *view) Iterate(from []byte, fn func(key []byte, value Comparable)) {
+	v.tree.Iterate(v.key(from), func(key []byte, value Comparable) {
+		fn(key[len(v.prefix):], value)
+	})
+}
+
+// Walk iterates over every key in the view that starts with a given prefix. If fn
+// returns an error, iteration will stop and the error will be returned
+func (v *view) Walk(from []byte, fn func(key []byte, value Comparable) error) error {
+	return v.tree.Walk(v.key(from), func(key []byte, value Comparable) error {
+		return fn(key[len(v.prefix):], value)
+	})
+}
+
+// IterateReverse iterates over every key in the view with a given prefix in descending order
+func (v *view) IterateReverse(prefix []byte, fn func(key []byte, value Comparable)) {
+	v.tree.IterateReverse(v.key(prefix), func(key []byte, value Comparable) {
+		fn(key[len(v.prefix):], value)
+	})
+}
+
+// Range iterates over every key in the view in order from start up to, but not including end.
+// If end is empty, all keys in the view from start onwards will be visited
+func (v *view) Range(start, end []byte, fn func(key []byte, value Comparable) bool) {
+	v.tree.Range(v.key(start), v.end(end), func(key []byte, value Comparable) bool {
+		return fn(key[len(v.prefix):], value)
+	})
+}
+
+// RangeReverse iterates over every key in the view in descending order from the last key
+// before end down to start. If end is empty, iteration will start from the last key in the view
+func (v *view) RangeReverse(start, end []byte, fn func(key []byte, value Comparable) bool) {
+	v.tree.RangeReverse(v.key(start), v.end(end), func(key []byte, value Comparable) bool {
+		return fn(key[len(v.prefix):], value)
+	})
+}
+
+// key returns a key with the view's prefix added to it
+func (v *view) key(key []byte) []byte {
+	k := make([]byte, len(v.prefix), len(v.prefix)+len(key))
+	copy(k, v.prefix)
+
+	return append(k, key...)
+}
+
+// end returns the end of a range in the view. an empty end is
+// replaced by the first key after all of the keys in the view
+func (v *view) end(end []byte) []byte {
+	if len(end) < 1 {
+		return prefixEnd(v.prefix)
+	}
+
+	return v.key(end)
+}
+
+// strip removes the view's prefix from a key returned by the tree,
+// discarding the key if it's outside of the view
+func (v *view) strip(key []byte, value Comparable, ok bool) ([]byte, Comparable, bool) {
+	if !ok || !bytes.HasPrefix(key, v.prefix) {
+		return nil, nil, false
+	}
+
+	return key[len(v.prefix):], value, true
+}
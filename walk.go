@@ -0,0 +1,136 @@
+package art
+
+// walker walks two trees in parallel, visiting their keys in order
+type walker struct {
+	a, b *ART
+	// called for every key that's visited, with a nil value for the tree
+	// that doesn't contain the key. the key is reused between calls
+	fn func(key []byte, va, vb Comparable)
+	// whether keys that are only in a or only in b are visited
+	left, right bool
+	// nodes that are in both trees are skipped if none of the keys
+	// under them have been changed at or after this version
+	since uint64
+}
+
+// position is a point part way through the prefix of a node. nodes
+// with different prefixes can be compared by moving through them a
+// byte at a time, until they line up with each other
+type position struct {
+	node *node
+	// the number of bytes of the node's prefix that have been consumed
+	offset int
+}
+
+func (w *walker) walk() {
+	w.compare(nil, position{node: w.a.root}, position{node: w.b.root})
+}
+
+// compare visits the keys under two positions with the same key
+func (w *walker) compare(key []byte, pa, pb position) {
+	if pa == pb && pa.node.unchanged(w.since) {
+		return
+	}
+
+	va, vb := pa.value(), pb.value()
+
+	switch {
+	case va == nil && vb == nil:
+	case vb == nil && !w.left:
+	case va == nil && !w.right:
+	default:
+		w.fn(key, va, vb)
+	}
+
+	ea, eb := pa.edges(w.a), pb.edges(w.b)
+
+	for i := 0; i < 256; {
+		ba, ca := pa.next(ea, i)
+		bb, cb := pb.next(eb, i)
+
+		switch {
+		case ca.node == nil && cb.node == nil:
+			return
+		case cb.node == nil || ca.node != nil && ba < bb:
+			if w.left {
+				w.only(w.a, append(key, ba), ca, true)
+			}
+			i = int(ba) + 1
+		case ca.node == nil || bb < ba:
+			if w.right {
+				w.only(w.b, append(key, bb), cb, false)
+			}
+			i = int(bb) + 1
+		default:
+			w.compare(append(key, ba), ca, cb)
+			i = int(ba) + 1
+		}
+	}
+}
+
+// only visits every key under a position that is only in one of the trees
+func (w *walker) only(t *ART, key []byte, p position, left bool) {
+	visit := func(key []byte, value Comparable) error {
+		if left {
+			w.fn(key, value, nil)
+		} else {
+			w.fn(key, nil, value)
+		}
+
+		return nil
+	}
+
+	full := make([]byte, len(key), len(key)+len(p.node.prefix)-p.offset)
+	copy(full, key)
+	full = append(full, p.node.prefix[p.offset:]...)
+
+	if p.node.value != nil {
+		visit(full, p.node.value)
+	}
+
+	t.iterate(full, p.node, visit)
+}
+
+// value returns the value at the position, if it's at the end of the node's prefix
+func (p position) value() Comparable {
+	if p.offset < len(p.node.prefix) {
+		return nil
+	}
+
+	return p.node.value
+}
+
+// edges returns the node's edges if the position is at the end of its prefix
+func (p position) edges(t *ART) edges {
+	if p.offset < len(p.node.prefix) {
+		return nil
+	}
+
+	return t.getEdges(p.node)
+}
+
+// next returns the first position after this one that is reached by a byte
+// that is equal to or greater than b. if the position is part way through the
+// node's prefix, the only position after it is the next byte of the prefix
+func (p position) next(e edges, b int) (byte, position) {
+	if e == nil {
+		c := p.node.prefix[p.offset]
+
+		if int(c) < b {
+			return 0, position{}
+		}
+
+		return c, position{node: p.node, offset: p.offset + 1}
+	}
+
+	if b > 255 {
+		return 0, position{}
+	}
+
+	c, next := e.ceiling(byte(b))
+	if next == nil {
+		return 0, position{}
+	}
+
+	return c, position{node: next}
+}